@@ -0,0 +1,411 @@
+package gonosql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// CheckProblemKind is the kind of inconsistency found by Check.
+type CheckProblemKind int
+
+const (
+	// CheckCorruptPage is a page that can't be read: its checksum, type or page number is wrong, or its content
+	// doesn't parse. What it references isn't checked.
+	CheckCorruptPage CheckProblemKind = iota + 1
+
+	// CheckUnsortedKeys is a node whose keys aren't in strictly increasing order.
+	CheckUnsortedKeys
+
+	// CheckSeparatorOrder is a node holding a key outside the range set by the separators of its ancestors.
+	CheckSeparatorOrder
+
+	// CheckLeafDepth is a leaf at another depth than the first leaf of its collection.
+	CheckLeafDepth
+
+	// CheckNodeSize is a node bigger than the max threshold, or a node other than a root that's empty or smaller than the
+	// min threshold. A node smaller than the min threshold is only a warning, since the tree may keep such nodes, like
+	// when splitting a node leaves too little in one of the halves or when merging two nodes would overflow a page.
+	CheckNodeSize
+
+	// CheckOverflowChain is an overflow chain that's shorter or longer than the value it holds.
+	CheckOverflowChain
+
+	// CheckPageReferencedTwice is a page referenced from two places, or released twice in the freelist.
+	CheckPageReferencedTwice
+
+	// CheckPageReachableAndFree is a page in use that's also in the freelist.
+	CheckPageReachableAndFree
+
+	// CheckPageOutOfRange is a page past the max page of the freelist, or one of the meta pages, referenced as another
+	// page.
+	CheckPageOutOfRange
+
+	// CheckPageLeaked is a page that's neither in use nor in the freelist, so it can't be reused. It's only a warning,
+	// since no data is lost.
+	CheckPageLeaked
+)
+
+func (k CheckProblemKind) String() string {
+	switch k {
+	case CheckCorruptPage:
+		return "corrupt page"
+	case CheckUnsortedKeys:
+		return "unsorted keys"
+	case CheckSeparatorOrder:
+		return "separator order"
+	case CheckLeafDepth:
+		return "leaf depth"
+	case CheckNodeSize:
+		return "node size"
+	case CheckOverflowChain:
+		return "overflow chain"
+	case CheckPageReferencedTwice:
+		return "page referenced twice"
+	case CheckPageReachableAndFree:
+		return "page reachable and free"
+	case CheckPageOutOfRange:
+		return "page out of range"
+	case CheckPageLeaked:
+		return "page leaked"
+	}
+	return fmt.Sprintf("CheckProblemKind(%d)", int(k))
+}
+
+// CheckProblem is an inconsistency found by Check.
+type CheckProblem struct {
+	Kind CheckProblemKind
+
+	// PageNum is the page the problem was found in.
+	PageNum uint64
+
+	// Collection is the path of names from the root collection to the collection the problem was found in. It's empty
+	// for the root collection and for the freelist.
+	Collection [][]byte
+
+	Reason string
+}
+
+func (p *CheckProblem) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "page %d", p.PageNum)
+	if len(p.Collection) > 0 {
+		fmt.Fprintf(&b, " of collection %q", bytes.Join(p.Collection, []byte("/")))
+	}
+	fmt.Fprintf(&b, ": %s: %s", p.Kind, p.Reason)
+	return b.String()
+}
+
+// CheckReport is the result of Check. The database is consistent if there are no problems. Warnings point at pages
+// that are valid but waste space.
+type CheckReport struct {
+	Problems []*CheckProblem
+	Warnings []*CheckProblem
+
+	// Collections is the number of collections checked, the root collection excluded.
+	Collections int
+
+	// ReachablePages is the number of pages in use: the pages of the freelist, and the node and overflow pages of all
+	// the collections. The meta pages aren't counted.
+	ReachablePages int
+
+	// FreePages is the number of pages in the freelist.
+	FreePages int
+
+	// MaxPage is the max page of the freelist, the last page of the file in use.
+	MaxPage uint64
+}
+
+// OK reports whether no problem was found.
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Check walks all the pages of the database and returns a report of the problems found. It reads the same snapshot as
+// other read transactions. See Tx.Check.
+func (db *DB) Check() (*CheckReport, error) {
+	var report *CheckReport
+	err := db.View(func(tx *Tx) error {
+		var err error
+		report, err = tx.Check()
+		return err
+	})
+	return report, err
+}
+
+// Check walks all the pages of the database as of the commit the transaction started from, and returns a report of
+// the problems found. The changes made by a write transaction aren't checked. It verifies the B-tree of every
+// collection, that every page is referenced at most once, either from a tree or from the freelist, and that the max
+// page of the freelist covers all of them. Corrupt pages are reported as problems, while an error is returned only if
+// the database couldn't be read. Nodes under the min threshold and pages that are neither in use nor free are
+// reported as warnings.
+func (tx *Tx) Check() (*CheckReport, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		tx:     tx,
+		report: &CheckReport{},
+		pages:  map[pageNum]struct{}{},
+		free:   map[pageNum]struct{}{},
+	}
+	err := c.check()
+	if err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+// checker holds the state of Tx.Check.
+type checker struct {
+	tx       *Tx
+	report   *CheckReport
+	freelist *freelist
+
+	// pages referenced so far, and the pages released in the freelist
+	pages map[pageNum]struct{}
+	free  map[pageNum]struct{}
+}
+
+func (c *checker) problem(kind CheckProblemKind, pgNum pageNum, path [][]byte, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, newCheckProblem(kind, pgNum, path, format, args...))
+}
+
+func (c *checker) warning(kind CheckProblemKind, pgNum pageNum, path [][]byte, format string, args ...any) {
+	c.report.Warnings = append(c.report.Warnings, newCheckProblem(kind, pgNum, path, format, args...))
+}
+
+func newCheckProblem(kind CheckProblemKind, pgNum pageNum, path [][]byte, format string, args ...any) *CheckProblem {
+	return &CheckProblem{
+		Kind:       kind,
+		PageNum:    uint64(pgNum),
+		Collection: path,
+		Reason:     fmt.Sprintf(format, args...),
+	}
+}
+
+// corrupt reports a corrupt page if err is one, and returns any other error.
+func (c *checker) corrupt(pgNum pageNum, path [][]byte, err error) error {
+	var corrupt *ErrCorruptPage
+	if errors.As(err, &corrupt) {
+		c.problem(CheckCorruptPage, pgNum, path, "%s", corrupt.Reason)
+		return nil
+	}
+	return err
+}
+
+// reference records a reference to a page. It returns false if the page can't be used, in which case what it
+// references isn't checked.
+func (c *checker) reference(pgNum pageNum, path [][]byte) bool {
+	if pgNum <= metaPage || pgNum > c.freelist.maxPage {
+		c.problem(CheckPageOutOfRange, pgNum, path, "page is out of the range of pages %d to %d", metaPage+1, c.freelist.maxPage)
+		return false
+	}
+
+	if _, ok := c.pages[pgNum]; ok {
+		c.problem(CheckPageReferencedTwice, pgNum, path, "page is referenced twice")
+		return false
+	}
+
+	c.pages[pgNum] = struct{}{}
+	c.report.ReachablePages++
+	return true
+}
+
+func (c *checker) check() error {
+	err := c.checkFreelist()
+	if err != nil || c.freelist == nil {
+		return err
+	}
+
+	root := newEmptyCollection()
+	root.root = c.tx.meta.root
+	err = c.checkCollection(root, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, pgNum := range c.freelist.releasedPages {
+		if _, ok := c.pages[pgNum]; ok {
+			c.problem(CheckPageReachableAndFree, pgNum, nil, "page is in use and in the freelist")
+		}
+	}
+
+	for pgNum := pageNum(metaPage + 1); pgNum <= c.freelist.maxPage; pgNum++ {
+		_, reachable := c.pages[pgNum]
+		_, released := c.free[pgNum]
+		if !reachable && !released {
+			c.warning(CheckPageLeaked, pgNum, nil, "page is neither in use nor in the freelist")
+		}
+	}
+	return nil
+}
+
+// checkFreelist reads the freelist of the snapshot and checks the pages it's stored in and the pages it releases. If
+// the freelist can't be read, it's reported and nothing else is checked, since the max page is unknown.
+func (c *checker) checkFreelist() error {
+	freelist := newFreelist()
+	for pgNum := c.tx.meta.freelistPage; pgNum != 0; {
+		if slices.Contains(freelist.pages, pgNum) {
+			c.problem(CheckPageReferencedTwice, pgNum, nil, "freelist chain loops back to the page")
+			break
+		}
+
+		p, err := c.tx.db.readPage(pgNum)
+		if err == nil {
+			err = p.verify(pageTypeFreelist)
+		}
+		if err != nil {
+			return c.corrupt(pgNum, nil, err)
+		}
+
+		freelist.pages = append(freelist.pages, pgNum)
+		pgNum = freelist.deserialize(p.body(), len(freelist.pages) == 1)
+	}
+	c.freelist = freelist
+	c.report.MaxPage = uint64(freelist.maxPage)
+
+	for _, pgNum := range freelist.pages {
+		c.reference(pgNum, nil)
+	}
+
+	for _, pgNum := range freelist.releasedPages {
+		if pgNum <= metaPage || pgNum > freelist.maxPage {
+			c.problem(CheckPageOutOfRange, pgNum, nil, "released page is out of the range of pages %d to %d", metaPage+1, freelist.maxPage)
+		}
+		if _, ok := c.free[pgNum]; ok {
+			c.problem(CheckPageReferencedTwice, pgNum, nil, "page is released twice")
+		}
+		c.free[pgNum] = struct{}{}
+	}
+	c.report.FreePages = len(c.free)
+	return nil
+}
+
+// checkCollection checks the tree of a collection, and the trees of the collections nested in it.
+func (c *checker) checkCollection(collection *Collection, path [][]byte) error {
+	leafDepth := 0
+	return c.checkNode(collection.root, path, nil, nil, 1, &leafDepth)
+}
+
+// checkNode checks a node and its subtree. The keys of the subtree have to be greater than min and smaller than max,
+// when they are set. leafDepth holds the depth of the first leaf of the collection, or 0 until one is found.
+func (c *checker) checkNode(pgNum pageNum, path [][]byte, min, max []byte, depth int, leafDepth *int) error {
+	if !c.reference(pgNum, path) {
+		return nil
+	}
+
+	node, err := c.tx.db.getNode(pgNum)
+	if err != nil {
+		return c.corrupt(pgNum, path, err)
+	}
+
+	if !node.isLeaf() && len(node.childNodes) != len(node.items)+1 {
+		c.problem(CheckCorruptPage, pgNum, path, "node has %d items and %d children", len(node.items), len(node.childNodes))
+		return nil
+	}
+
+	size := float32(node.nodeSize())
+	if size > c.tx.db.maxThreshold() {
+		c.problem(CheckNodeSize, pgNum, path, "node takes %d bytes, more than the max threshold of %.0f bytes", node.nodeSize(), c.tx.db.maxThreshold())
+	} else if depth > 1 && len(node.items) == 0 {
+		c.problem(CheckNodeSize, pgNum, path, "node has no items, but isn't the root of its collection")
+	} else if depth > 1 && size < c.tx.db.minThreshold() {
+		c.warning(CheckNodeSize, pgNum, path, "node takes %d bytes, less than the min threshold of %.0f bytes", node.nodeSize(), c.tx.db.minThreshold())
+	}
+
+	for i, item := range node.items {
+		if i > 0 && bytes.Compare(node.items[i-1].key, item.key) >= 0 {
+			c.problem(CheckUnsortedKeys, pgNum, path, "key %q isn't greater than the key %q before it", item.key, node.items[i-1].key)
+		}
+		if (min != nil && bytes.Compare(item.key, min) <= 0) || (max != nil && bytes.Compare(item.key, max) >= 0) {
+			c.problem(CheckSeparatorOrder, pgNum, path, "key %q is out of the range (%q, %q) of its subtree", item.key, min, max)
+		}
+
+		err = c.checkItem(pgNum, item, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if node.isLeaf() {
+		if *leafDepth == 0 {
+			*leafDepth = depth
+		} else if depth != *leafDepth {
+			c.problem(CheckLeafDepth, pgNum, path, "leaf is at depth %d, while other leaves are at depth %d", depth, *leafDepth)
+		}
+		return nil
+	}
+
+	for i, child := range node.childNodes {
+		childMin, childMax := min, max
+		if i > 0 {
+			childMin = node.items[i-1].key
+		}
+		if i < len(node.items) {
+			childMax = node.items[i].key
+		}
+
+		err = c.checkNode(child, path, childMin, childMax, depth+1, leafDepth)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkItem checks the pages referenced by an item: the tree of a nested collection or an overflow chain.
+func (c *checker) checkItem(pgNum pageNum, item *Item, path [][]byte) error {
+	if item.collection {
+		if len(item.value) != collectionSize {
+			c.problem(CheckCorruptPage, pgNum, path, "record of collection %q is %d bytes long", item.key, len(item.value))
+			return nil
+		}
+
+		collection := newEmptyCollection()
+		collection.deserialize(item)
+		c.report.Collections++
+		return c.checkCollection(collection, append(path[:len(path):len(path)], item.key))
+	}
+
+	if item.isOverflow() {
+		return c.checkOverflow(item, path)
+	}
+	return nil
+}
+
+// checkOverflow checks that the overflow chain of an item has as many pages as its value needs.
+func (c *checker) checkOverflow(item *Item, path [][]byte) error {
+	capacity := c.tx.db.overflowPageCapacity()
+	expected := (item.overflowSize + capacity - 1) / capacity
+
+	count := 0
+	for pgNum := item.overflowPage; pgNum != 0; count++ {
+		if !c.reference(pgNum, path) {
+			return nil
+		}
+
+		p, err := c.tx.db.readPage(pgNum)
+		if err == nil {
+			err = p.verify(pageTypeOverflow)
+		}
+		if err != nil {
+			return c.corrupt(pgNum, path, err)
+		}
+
+		if count == expected {
+			c.problem(CheckOverflowChain, pgNum, path, "value of key %q takes %d bytes, but its chain goes on", item.key, item.overflowSize)
+			return nil
+		}
+		pgNum = pageNum(binary.LittleEndian.Uint64(p.body()))
+	}
+
+	if count < expected {
+		c.problem(CheckOverflowChain, item.overflowPage, path, "value of key %q takes %d bytes, but its chain has %d pages instead of %d", item.key, item.overflowSize, count, expected)
+	}
+	return nil
+}
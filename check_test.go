@@ -0,0 +1,313 @@
+package gonosql
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runRandomWorkload puts and removes random keys, with values of random sizes up to maxValueSize, in a collection and
+// in a collection nested in it, and checks the database after every commit.
+func runRandomWorkload(t *testing.T, db *DB, rounds int, maxValueSize int) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < rounds; round++ {
+		err := db.Update(func(tx *Tx) error {
+			collection, err := tx.GetCollection(testCollectionName)
+			require.NoError(t, err)
+			if collection == nil {
+				collection, err = tx.CreateCollection(testCollectionName)
+				require.NoError(t, err)
+			}
+			nested, err := collection.GetCollection([]byte("nested"))
+			require.NoError(t, err)
+			if nested == nil {
+				nested, err = collection.CreateCollection([]byte("nested"))
+				require.NoError(t, err)
+			}
+
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key%05d", r.Intn(2000)))
+				if r.Intn(3) == 0 {
+					require.NoError(t, collection.Remove(key))
+					require.NoError(t, nested.Remove(key))
+					continue
+				}
+
+				value := make([]byte, r.Intn(maxValueSize))
+				require.NoError(t, collection.Put(key, value))
+				require.NoError(t, nested.Put(key, value[:len(value)/10]))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		report, err := db.Check()
+		require.NoError(t, err)
+		require.Empty(t, report.Problems, "round %d", round)
+		for _, warning := range report.Warnings {
+			require.NotEqual(t, CheckPageLeaked, warning.Kind, warning.String())
+		}
+		require.Equal(t, 2, report.Collections)
+		require.Equal(t, report.MaxPage-metaPage, uint64(report.ReachablePages+report.FreePages))
+	}
+}
+
+func TestCheck_Consistent(t *testing.T) {
+	for _, options := range []*Options{
+		{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage},
+		{MinFillPercent: 0.5, MaxFillPercent: 0.95},
+		{MinFillPercent: 0.5, MaxFillPercent: 0.95, PageSize: minPageSize},
+	} {
+		t.Run(fmt.Sprintf("%.2f-%.2f/%d", options.MinFillPercent, options.MaxFillPercent, options.PageSize), func(t *testing.T) {
+			db, err := Open(getTempFileName(), options)
+			require.NoError(t, err)
+			defer db.Close()
+
+			runRandomWorkload(t, db, 30, 3000)
+		})
+	}
+}
+
+func TestCheck_WriteTxChecksItsSnapshot(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+	putTestItems(t, db, "0", "1", "2")
+
+	tx := db.WriteTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("3"), createItem("3")))
+	require.NoError(t, collection.Remove(createItem("0")))
+
+	report, err := tx.Check()
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	require.NoError(t, tx.Rollback())
+
+	_, err = tx.Check()
+	assert.ErrorIs(t, err, ErrTxClosed)
+}
+
+// testCollectionRoot returns the root node of the test collection, read from the disk.
+func testCollectionRoot(t *testing.T, db *DB) *Node {
+	tx := db.ReadTx()
+	defer tx.Rollback()
+
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	node, err := db.getNode(collection.root)
+	require.NoError(t, err)
+	return node
+}
+
+// rewriteTestNode applies fn to a node and writes it back in place, bypassing copy-on-write.
+func rewriteTestNode(t *testing.T, db *DB, pgNum pageNum, fn func(node *Node)) {
+	node, err := db.getNode(pgNum)
+	require.NoError(t, err)
+	fn(node)
+	require.NoError(t, db.writePage(db.serializeNode(node)))
+}
+
+func assertCheckProblem(t *testing.T, db *DB, kind CheckProblemKind, pgNum pageNum) {
+	report, err := db.Check()
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+
+	for _, problem := range report.Problems {
+		if problem.Kind == kind && problem.PageNum == uint64(pgNum) {
+			return
+		}
+	}
+	assert.Fail(t, "problem not found", "no %s problem in page %d in %v", kind, pgNum, report.Problems)
+}
+
+func TestCheck_Problems(t *testing.T) {
+	keys := make([]string, mockNumberOfElements)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	tests := []struct {
+		name string
+
+		// corrupt corrupts the database, whose test collection has a root and leaves, and returns the page the
+		// problem is expected in.
+		corrupt func(t *testing.T, db *DB, path string) pageNum
+		kind    CheckProblemKind
+	}{
+		{
+			name: "unsorted keys",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				leaf := testCollectionRoot(t, db).childNodes[0]
+				rewriteTestNode(t, db, leaf, func(node *Node) {
+					node.items[0], node.items[1] = node.items[1], node.items[0]
+				})
+				return leaf
+			},
+			kind: CheckUnsortedKeys,
+		},
+		{
+			name: "separator order",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				root := testCollectionRoot(t, db)
+				leaf := root.childNodes[0]
+				rewriteTestNode(t, db, leaf, func(node *Node) {
+					last := node.items[len(node.items)-1]
+					last.key = append(append([]byte{}, root.items[0].key...), 'x')
+				})
+				return leaf
+			},
+			kind: CheckSeparatorOrder,
+		},
+		{
+			name: "leaf depth",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				root := testCollectionRoot(t, db)
+
+				// The first leaf is moved one level down, under a node without items
+				branch := NewNodeForSerialization([]*Item{}, []pageNum{root.childNodes[0]})
+				branch.pgNum = db.getNextPage()
+				require.NoError(t, db.writePage(db.serializeNode(branch)))
+				require.NoError(t, db.writeFreelist(db.freelist.pages, db.freelist))
+				rewriteTestNode(t, db, root.pgNum, func(node *Node) {
+					node.childNodes[0] = branch.pgNum
+				})
+
+				// The first leaf sets the depth the others are compared to
+				return root.childNodes[1]
+			},
+			kind: CheckLeafDepth,
+		},
+		{
+			name: "node size",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				leaf := testCollectionRoot(t, db).childNodes[0]
+				rewriteTestNode(t, db, leaf, func(node *Node) {
+					// Growing the keys at their end keeps them in order, since they differ from their first byte
+					for _, item := range node.items {
+						item.key = append(item.key, memset([]byte("k"), 800)...)
+						if db.isOverPopulated(node) {
+							break
+						}
+					}
+					require.LessOrEqual(t, node.nodeSize(), db.bodySize())
+				})
+				return leaf
+			},
+			kind: CheckNodeSize,
+		},
+		{
+			name: "empty node",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				leaf := testCollectionRoot(t, db).childNodes[1]
+				rewriteTestNode(t, db, leaf, func(node *Node) {
+					node.items = nil
+				})
+				return leaf
+			},
+			kind: CheckNodeSize,
+		},
+		{
+			name: "page referenced twice",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				root := testCollectionRoot(t, db)
+				rewriteTestNode(t, db, root.pgNum, func(node *Node) {
+					node.childNodes[1] = node.childNodes[0]
+				})
+				return root.childNodes[0]
+			},
+			kind: CheckPageReferencedTwice,
+		},
+		{
+			name: "page reachable and free",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				leaf := testCollectionRoot(t, db).childNodes[0]
+				freelist := db.freelist.withReleasedPages([]pageNum{leaf})
+				require.NoError(t, db.writeFreelist(db.freelist.pages, freelist))
+				return leaf
+			},
+			kind: CheckPageReachableAndFree,
+		},
+		{
+			name: "page out of range",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				root := testCollectionRoot(t, db)
+				rewriteTestNode(t, db, root.pgNum, func(node *Node) {
+					node.childNodes[0] = db.maxPage + 10
+				})
+				return db.maxPage + 10
+			},
+			kind: CheckPageOutOfRange,
+		},
+		{
+			name: "corrupt page",
+			corrupt: func(t *testing.T, db *DB, path string) pageNum {
+				leaf := testCollectionRoot(t, db).childNodes[0]
+				corruptTestPage(t, path, leaf)
+				return leaf
+			},
+			kind: CheckCorruptPage,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := getTempFileName()
+			db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+			require.NoError(t, err)
+			defer db.Close()
+
+			putTestItems(t, db, keys...)
+			require.Greater(t, len(testCollectionRoot(t, db).childNodes), 1)
+			report, err := db.Check()
+			require.NoError(t, err)
+			require.True(t, report.OK(), report.Problems)
+
+			pgNum := test.corrupt(t, db, path)
+			assertCheckProblem(t, db, test.kind, pgNum)
+		})
+	}
+}
+
+func TestCheck_OverflowChain(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	key := []byte("key")
+	err := db.Update(func(tx *Tx) error {
+		collection, err := tx.CreateCollection(testCollectionName)
+		require.NoError(t, err)
+		return collection.Put(key, memset([]byte("v"), 2*testPageSize))
+	})
+	require.NoError(t, err)
+
+	// The value claims to be longer than its chain
+	root := testCollectionRoot(t, db)
+	rewriteTestNode(t, db, root.pgNum, func(node *Node) {
+		node.items[0].overflowSize += 2 * db.overflowPageCapacity()
+	})
+	assertCheckProblem(t, db, CheckOverflowChain, root.items[0].overflowPage)
+
+	// The value claims to be shorter than its chain
+	rewriteTestNode(t, db, root.pgNum, func(node *Node) {
+		node.items[0].overflowSize = 1
+	})
+	assertCheckProblem(t, db, CheckOverflowChain, root.items[0].overflowPage+1)
+}
+
+func TestCheckProblem_String(t *testing.T) {
+	problem := &CheckProblem{
+		Kind:       CheckUnsortedKeys,
+		PageNum:    12,
+		Collection: [][]byte{[]byte("users"), []byte("tenant1")},
+		Reason:     "key isn't greater than the key before it",
+	}
+	assert.Equal(t, `page 12 of collection "users/tenant1": unsorted keys: key isn't greater than the key before it`, problem.String())
+
+	problem.Collection = nil
+	assert.Equal(t, `page 12: unsorted keys: key isn't greater than the key before it`, problem.String())
+}
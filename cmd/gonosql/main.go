@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/thanhtranna/gonosql"
+)
+
+// errCheckFailed is returned by the check subcommand when the database has problems, which are printed already.
+var errCheckFailed = errors.New("the database is inconsistent")
+
+func main() {
+	args := os.Args[1:]
+	command := run
+	if len(args) > 0 && args[0] == "check" {
+		command = check
+		args = args[1:]
+	}
+
+	path := "nosql.db"
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	if err := command(path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(path string) error {
+	db, err := gonosql.Open(path, gonosql.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx := db.WriteTx()
+	name := []byte("test")
+	collection, err := tx.GetCollection(name)
+	if err == nil && collection == nil {
+		collection, err = tx.CreateCollection(name)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	key, value := []byte("key1"), []byte("value1")
+	if err = collection.Put(key, value); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// check opens the database in read-only mode and prints the report of DB.Check.
+func check(path string) error {
+	options := *gonosql.DefaultOptions
+	options.ReadOnly = true
+	db, err := gonosql.Open(path, &options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.Check()
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println("error:", problem)
+	}
+	for _, warning := range report.Warnings {
+		fmt.Println("warning:", warning)
+	}
+	fmt.Printf("%d collections, %d pages in use, %d free pages, max page %d: %d problems, %d warnings\n",
+		report.Collections, report.ReachablePages, report.FreePages, report.MaxPage, len(report.Problems), len(report.Warnings))
+
+	if !report.OK() {
+		return errCheckFailed
+	}
+	return nil
+}
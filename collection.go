@@ -1,4 +1,4 @@
-package main
+package gonosql
 
 import (
 	"bytes"
@@ -10,8 +10,16 @@ type Collection struct {
 	root    pageNum
 	counter uint64
 
+	// collections opened through this collection during the transaction. If their root or counter change, their
+	// records are rewritten in this collection on commit.
+	collections map[string]*Collection
+
+	// the root and counter stored in the collection's record
+	persistedRoot    pageNum
+	persistedCounter uint64
+
 	// associated transaction
-	tx *tx
+	tx *Tx
 }
 
 func newCollection(name []byte, root pageNum) *Collection {
@@ -25,8 +33,37 @@ func newEmptyCollection() *Collection {
 	return &Collection{}
 }
 
+// trackCollection registers a collection whose record is stored in this collection, so the record is kept up to date
+// on commit.
+func (c *Collection) trackCollection(collection *Collection) {
+	if c.collections == nil {
+		c.collections = map[string]*Collection{}
+	}
+
+	collection.persistedRoot = collection.root
+	collection.persistedCounter = collection.counter
+	c.collections[string(collection.name)] = collection
+}
+
+// isModified returns whether the root or the counter of the collection changed since its record was written.
+func (c *Collection) isModified() bool {
+	return c.root != c.persistedRoot || c.counter != c.persistedCounter
+}
+
+// persistIn rewrites the record of the collection in the collection holding it.
+func (c *Collection) persistIn(parent *Collection) error {
+	err := parent.put(c.serialize())
+	if err != nil {
+		return err
+	}
+
+	c.persistedRoot = c.root
+	c.persistedCounter = c.counter
+	return nil
+}
+
 func (c *Collection) ID() uint64 {
-	if !c.tx.write {
+	if !c.tx.write || c.tx.closed {
 		return 0
 	}
 
@@ -42,7 +79,10 @@ func (c *Collection) serialize() *Item {
 	leftPos += pageNumSize
 	binary.LittleEndian.PutUint64(b[leftPos:], c.counter)
 	leftPos += counterSize
-	return newItem(c.name, b)
+
+	item := newItem(c.name, b)
+	item.collection = true
+	return item
 }
 
 func (c *Collection) deserialize(item *Item) {
@@ -58,21 +98,264 @@ func (c *Collection) deserialize(item *Item) {
 	}
 }
 
+// CreateCollection creates a collection nested in this collection under the given name. ErrCollectionExists is
+// returned if the collection already exists, and ErrIncompatibleValue if the name is the key of a value.
+func (c *Collection) CreateCollection(name []byte) (*Collection, error) {
+	if err := c.tx.writable(); err != nil {
+		return nil, err
+	}
+
+	newCollectionPage := c.tx.writeNode(c.tx.newNode([]*Item{}, []pageNum{}))
+	return c.createCollection(newCollection(name, newCollectionPage.pgNum))
+}
+
+func (c *Collection) createCollection(collection *Collection) (*Collection, error) {
+	existing, err := c.find(collection.name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.collection {
+			return nil, ErrCollectionExists
+		}
+		return nil, ErrIncompatibleValue
+	}
+
+	collection.tx = c.tx
+	err = c.put(collection.serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	c.trackCollection(collection)
+	return collection, nil
+}
+
+// GetCollection returns the collection nested in this collection under the given name, or nil if there's none.
+// ErrIncompatibleValue is returned if the name is the key of a value.
+func (c *Collection) GetCollection(name []byte) (*Collection, error) {
+	if err := c.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if collection, ok := c.collections[string(name)]; ok {
+		return collection, nil
+	}
+
+	item, err := c.find(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return nil, nil
+	}
+	if !item.collection {
+		return nil, ErrIncompatibleValue
+	}
+
+	collection := newEmptyCollection()
+	collection.deserialize(item)
+	collection.tx = c.tx
+	c.trackCollection(collection)
+	return collection, nil
+}
+
+// DeleteCollection deletes the collection nested in this collection under the given name, and releases all of its
+// pages once the transaction commits. ErrIncompatibleValue is returned if the name is the key of a value.
+func (c *Collection) DeleteCollection(name []byte) error {
+	if err := c.tx.writable(); err != nil {
+		return err
+	}
+
+	collection, err := c.GetCollection(name)
+	if err != nil || collection == nil {
+		return err
+	}
+
+	err = collection.free()
+	if err != nil {
+		return err
+	}
+
+	err = c.remove(name, true)
+	if err != nil {
+		return err
+	}
+
+	delete(c.collections, string(name))
+	return nil
+}
+
+// free marks all the pages of the collection for deletion: the pages of its nodes, the overflow pages of its values and
+// the pages of the collections nested in it. Like other deleted pages, they are released only once the transaction
+// commits.
+func (c *Collection) free() error {
+	return c.freeNode(c.root)
+}
+
+func (c *Collection) freeNode(pgNum pageNum) error {
+	node, err := c.tx.getNode(pgNum)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range node.items {
+		if item.collection {
+			collection, err := c.GetCollection(item.key)
+			if err != nil {
+				return err
+			}
+
+			err = collection.free()
+			if err != nil {
+				return err
+			}
+		} else if item.isOverflow() {
+			err = c.tx.freeOverflow(item.overflowPage, item.overflowSize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, child := range node.childNodes {
+		err = c.freeNode(child)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.tx.deleteNode(node)
+	return nil
+}
+
+// RenameCollection moves the collection nested in this collection under oldName to newName. Only the record of the
+// collection is moved, its tree stays in place. ErrCollectionNotFound is returned if there's no collection named
+// oldName, and ErrCollectionExists if newName is already taken.
+func (c *Collection) RenameCollection(oldName, newName []byte) error {
+	if err := c.tx.writable(); err != nil {
+		return err
+	}
+
+	collection, err := c.GetCollection(oldName)
+	if err != nil {
+		return err
+	}
+	if collection == nil {
+		return ErrCollectionNotFound
+	}
+	if bytes.Equal(oldName, newName) {
+		return nil
+	}
+
+	existing, err := c.find(newName)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.collection {
+			return ErrCollectionExists
+		}
+		return ErrIncompatibleValue
+	}
+
+	err = c.remove(oldName, true)
+	if err != nil {
+		return err
+	}
+	delete(c.collections, string(oldName))
+
+	collection.name = newName
+	err = c.put(collection.serialize())
+	if err != nil {
+		return err
+	}
+
+	c.trackCollection(collection)
+	return nil
+}
+
+// ForEachCollection calls fn for every collection nested in this collection, in name order. The iteration stops at
+// the first error returned by fn, and the error is returned. fn mustn't create, delete or rename collections in this
+// collection.
+func (c *Collection) ForEachCollection(fn func(name []byte, collection *Collection) error) error {
+	if err := c.tx.checkOpen(); err != nil {
+		return err
+	}
+
+	cursor := c.Cursor()
+	item, err := cursor.First()
+	for ; item != nil; item, err = cursor.Next() {
+		if err != nil {
+			return err
+		}
+		if !item.collection {
+			continue
+		}
+
+		collection, err := c.GetCollection(item.key)
+		if err != nil {
+			return err
+		}
+
+		err = fn(item.key, collection)
+		if err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// ListCollections returns the names of the collections nested in this collection, in name order.
+func (c *Collection) ListCollections() ([][]byte, error) {
+	var names [][]byte
+	err := c.ForEachCollection(func(name []byte, _ *Collection) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
 // Put adds a key to the tree. It finds the correct node and the insertion index and adds the item. When performing the
 // search, the ancestors are returned as well. This way we can iterate over them to check which nodes were modified and
 // re-balance by splitting them accordingly. If the root has too many items, then a new root of a new layer is
 // created and the created nodes from the split are added as children.
 func (c *Collection) Put(key []byte, value []byte) error {
-	if !c.tx.write {
-		return writeInsideReadTxErr
+	if err := c.tx.writable(); err != nil {
+		return err
 	}
 
-	i := newItem(key, value)
+	return c.put(newItem(key, value))
+}
+
+// put adds an item to the tree, either a value or the record of a nested collection. An existing item is replaced
+// only by an item of the same kind.
+func (c *Collection) put(i *Item) error {
+	// A value is stored in overflow pages as well if it doesn't fit in a node with its key, which a big
+	// Options.MaxInlineValueSize allows
+	maxItemSize := c.tx.db.maxItemSize()
+	if len(i.value) > c.tx.db.inlineValueThreshold() || i.size() > maxItemSize {
+		i.overflowSize = len(i.value)
+	}
+
+	if newItem(i.key, nil).size() > maxItemSize {
+		return ErrKeyTooLarge
+	}
+	if i.size() > maxItemSize {
+		return ErrValueTooLarge
+	}
 
 	// On first insertion the root node does not exist, so it should be created
 	var root *Node
 	var err error
 	if c.root == 0 {
+		c.writeOverflow(i)
 		root = c.tx.writeNode(c.tx.newNode([]*Item{i}, []pageNum{}))
 		c.root = root.pgNum
 		return nil
@@ -90,9 +373,23 @@ func (c *Collection) Put(key []byte, value []byte) error {
 	}
 
 	// If key already exists
-	if nodeToInsertIn.items != nil && insertionIndex < len(nodeToInsertIn.items) && bytes.Compare(nodeToInsertIn.items[insertionIndex].key, key) == 0 {
+	if nodeToInsertIn.items != nil && insertionIndex < len(nodeToInsertIn.items) && bytes.Compare(nodeToInsertIn.items[insertionIndex].key, i.key) == 0 {
+		existing := nodeToInsertIn.items[insertionIndex]
+		if existing.collection != i.collection {
+			return ErrIncompatibleValue
+		}
+
+		// The old value's overflow pages aren't referenced anymore
+		if existing.isOverflow() {
+			err = c.tx.freeOverflow(existing.overflowPage, existing.overflowSize)
+			if err != nil {
+				return err
+			}
+		}
+		c.writeOverflow(i)
 		nodeToInsertIn.items[insertionIndex] = i
 	} else {
+		c.writeOverflow(i)
 		// Add item to the leaf node
 		nodeToInsertIn.addItem(i, insertionIndex)
 	}
@@ -114,22 +411,49 @@ func (c *Collection) Put(key []byte, value []byte) error {
 	}
 
 	// Handle root
-	rootNode := ancestors[0]
-	if rootNode.isOverPopulated() {
-		newRoot := c.tx.newNode([]*Item{}, []pageNum{rootNode.pgNum})
-		newRoot.split(rootNode, 0)
-
-		// commit newly created root
-		newRoot = c.tx.writeNode(newRoot)
+	c.splitRoot(ancestors[0])
+	return nil
+}
 
-		c.root = newRoot.pgNum
+// splitRoot splits the root node if it's over-populated, under a new root.
+func (c *Collection) splitRoot(rootNode *Node) {
+	if !rootNode.isOverPopulated() {
+		return
 	}
 
-	return nil
+	newRoot := c.tx.newNode([]*Item{}, []pageNum{rootNode.pgNum})
+	newRoot.split(rootNode, 0)
+
+	// commit newly created root
+	newRoot = c.tx.writeNode(newRoot)
+
+	c.root = newRoot.pgNum
+}
+
+// writeOverflow moves the value of an item that is too big to be stored inline into overflow pages.
+func (c *Collection) writeOverflow(i *Item) {
+	if i.isOverflow() {
+		i.overflowPage = c.tx.writeOverflow(i.value)
+	}
 }
 
-// Find Returns an item according based on the given key by performing a binary search.
+// Find Returns an item according based on the given key by performing a binary search. Keys holding nested
+// collections have no value, so nil is returned for them.
 func (c *Collection) Find(key []byte) (*Item, error) {
+	if err := c.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	item, err := c.find(key)
+	if err != nil || item == nil || item.collection {
+		return nil, err
+	}
+
+	return c.tx.loadValue(item)
+}
+
+// find returns the item of the given key, whether it's a value or a nested collection, without loading its value.
+func (c *Collection) find(key []byte) (*Item, error) {
 	n, err := c.tx.getNode(c.root)
 	if err != nil {
 		return nil, err
@@ -151,10 +475,16 @@ func (c *Collection) Find(key []byte) (*Item, error) {
 // siblings don't have enough items, then merging occurs. If the root is without items after a split, then the root is
 // removed and the tree is one level shorter.
 func (c *Collection) Remove(key []byte) error {
-	if !c.tx.write {
-		return writeInsideReadTxErr
+	if err := c.tx.writable(); err != nil {
+		return err
 	}
 
+	return c.remove(key, false)
+}
+
+// remove removes an item from the tree, either a value or the record of a nested collection, as long as it's of the
+// expected kind.
+func (c *Collection) remove(key []byte, collection bool) error {
 	// Find the path to the node where the deletion should happen
 	rootNode, err := c.tx.getNode(c.root)
 	if err != nil {
@@ -170,6 +500,17 @@ func (c *Collection) Remove(key []byte) error {
 		return nil
 	}
 
+	if nodeToRemoveFrom.items[removeItemIndex].collection != collection {
+		return ErrIncompatibleValue
+	}
+
+	if removedItem := nodeToRemoveFrom.items[removeItemIndex]; removedItem.isOverflow() {
+		err = c.tx.freeOverflow(removedItem.overflowPage, removedItem.overflowSize)
+		if err != nil {
+			return err
+		}
+	}
+
 	if nodeToRemoveFrom.isLeaf() {
 		nodeToRemoveFrom.removeItemFromLeaf(removeItemIndex)
 	} else {
@@ -186,6 +527,8 @@ func (c *Collection) Remove(key []byte) error {
 	}
 
 	// Re-balance the nodes all the way up. Start From one node before the last and go all the way up. Exclude root.
+	// Nodes may grow as well, since the item replacing a removed or rotated separator may be bigger than it, in which
+	// case they are split.
 	for i := len(ancestors) - 2; i >= 0; i-- {
 		previousNode := ancestors[i]
 		node := ancestors[i+1]
@@ -194,15 +537,19 @@ func (c *Collection) Remove(key []byte) error {
 			if err != nil {
 				return err
 			}
+		} else if node.isOverPopulated() {
+			previousNode.split(node, ancestorsIndexes[i+1])
 		}
 	}
 
 	rootNode = ancestors[0]
-	// If the root has no items after re-balancing, there's no need to save it because we ignore it.
+	// If the root has no items after re-balancing, its only child becomes the root and its page is released.
 	if len(rootNode.items) == 0 && len(rootNode.childNodes) > 0 {
-		c.root = ancestors[1].pgNum
+		c.root = rootNode.childNodes[0]
+		c.tx.deleteNode(rootNode)
 	}
 
+	c.splitRoot(rootNode)
 	return nil
 }
 
@@ -0,0 +1,348 @@
+package gonosql
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+)
+
+// compactTxSize is the number of key and value bytes copied by Compact in a single transaction. The copy is split into
+// several transactions, so it never holds the whole database in memory.
+const compactTxSize = 16 * 1024 * 1024
+
+// Compact copies all the collections of the database into a new database file at dst, which mustn't exist. The keys are
+// copied in order and the nodes are filled up to the max fill percent, so the new file has no free pages and its nodes
+// are densely packed. The database is read through a read transaction, so it can be used during the copy, but the
+// changes committed meanwhile aren't copied. The new file has the page size of the database. If the copy fails, the new
+// file is removed.
+func (db *DB) Compact(dst string) error {
+	// The file is created here, so a file created at dst in the meantime isn't overwritten. Open initializes it.
+	file, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	// The new file is removed as well if the copy panics
+	copied := false
+	defer func() {
+		if !copied {
+			_ = os.Remove(dst)
+		}
+	}()
+
+	err = file.Close()
+	if err == nil {
+		err = db.compactInto(dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	copied = true
+	return nil
+}
+
+// compactInto copies all the collections of the database into the new database file at dst.
+func (db *DB) compactInto(dst string) error {
+	// Splitting a node leaves at least the min fill percent in the left node. The keys are inserted in order, so the
+	// left node is never written again, and the min fill percent is raised as much as it can be without the left node
+	// ending over the max fill percent after taking an item.
+	minFillPercent := max(db.minFillPercent, db.maxFillPercent-float32(db.maxItemSize())/float32(db.bodySize()))
+	dstDB, err := Open(dst, &Options{
+		PageSize:           db.pageSize,
+		MinFillPercent:     minFillPercent,
+		MaxFillPercent:     db.maxFillPercent,
+		MaxInlineValueSize: db.maxInlineValueSize,
+		SyncMode:           db.syncMode,
+	})
+	if err != nil {
+		return err
+	}
+
+	c := &compactor{dst: dstDB, tx: dstDB.WriteTx()}
+	err = db.View(func(tx *Tx) error {
+		return c.copyCollection(tx.getRootCollection(), nil)
+	})
+	if err == nil {
+		err = c.tx.Commit()
+	} else {
+		_ = c.tx.Rollback()
+	}
+
+	closeErr := dstDB.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// compactor copies collections into the database Compact writes.
+type compactor struct {
+	dst *DB
+	tx  *Tx
+
+	// size is the number of key and value bytes copied in the current transaction
+	size int
+}
+
+// copyCollection copies the items of a collection, and the collections nested in it, into the collection at the given
+// path from the root collection of the new database. The number of items copied is checked against the number of items
+// in the tree of the collection, so the copy fails rather than silently missing some of them.
+func (c *compactor) copyCollection(src *Collection, path [][]byte) error {
+	cursor := src.Cursor()
+	count := 0
+	for item, err := cursor.First(); ; item, err = cursor.Next() {
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			return checkCopiedCount(src, count)
+		}
+		count++
+
+		if !item.IsCollection() {
+			err = c.put(path, item.Key(), item.Value())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		nested, err := src.GetCollection(item.Key())
+		if err != nil {
+			return err
+		}
+
+		err = c.createCollection(path, nested)
+		if err != nil {
+			return err
+		}
+
+		err = c.copyCollection(nested, append(path[:len(path):len(path)], item.Key()))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkCopiedCount returns an error if the number of items copied from a collection isn't the number of items in its
+// tree.
+func checkCopiedCount(src *Collection, count int) error {
+	stats, err := src.Stats()
+	if err != nil {
+		return err
+	}
+	if count != stats.KeyCount {
+		return fmt.Errorf("could not compact collection %q: copied %d of its %d items", src.name, count, stats.KeyCount)
+	}
+	return nil
+}
+
+// collection returns the collection at the given path from the root collection of the new database.
+func (c *compactor) collection(path [][]byte) (*Collection, error) {
+	collection := c.tx.getRootCollection()
+	for _, name := range path {
+		var err error
+		collection, err = collection.GetCollection(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return collection, nil
+}
+
+// createCollection creates a copy of the given collection, with its counter, in the collection at the given path.
+func (c *compactor) createCollection(path [][]byte, src *Collection) error {
+	parent, err := c.collection(path)
+	if err != nil {
+		return err
+	}
+
+	collection, err := parent.CreateCollection(src.name)
+	if err != nil {
+		return err
+	}
+
+	collection.counter = src.counter
+	return nil
+}
+
+// put copies an item into the collection at the given path. The transaction is committed, and a new one is started,
+// once it copied compactTxSize bytes.
+func (c *compactor) put(path [][]byte, key, value []byte) error {
+	if c.size >= compactTxSize {
+		err := c.tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		c.tx = c.dst.WriteTx()
+		c.size = 0
+	}
+
+	collection, err := c.collection(path)
+	if err != nil {
+		return err
+	}
+
+	c.size += len(key) + len(value)
+	return collection.Put(key, value)
+}
+
+// CompactInPlace shrinks the database file by moving the pages in use at its end into free pages at its start, and
+// truncating the free pages left at its end. Pages are moved like any commit moves pages, so a crash during the
+// compaction leaves the database consistent. It runs as a series of write transactions, and pages still read by open
+// read transactions aren't moved, so the file may not shrink as much while they are open.
+func (db *DB) CompactInPlace() error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	// Moving a page moves its ancestors as well, and the pages they are moved from are free only once the move is
+	// committed. Pages are moved until the end of the used pages stops moving back.
+	highest := pageNum(math.MaxUint64)
+	for {
+		high, err := db.compactPass()
+		if err != nil {
+			return err
+		}
+		if high >= highest {
+			break
+		}
+		highest = high
+	}
+
+	return db.truncate()
+}
+
+// compactPass moves the pages in use past the page the database would end at if it had no free pages into the lowest
+// free pages, in a single transaction. It returns the highest page in use when the pass started.
+func (db *DB) compactPass() (pageNum, error) {
+	// The pages freed by the previous pass can be reused only once it's synced
+	err := db.flushSync()
+	if err != nil {
+		return 0, err
+	}
+
+	tx := db.WriteTx()
+	high := db.freelist.highestUsedPage()
+
+	rootCollection := tx.getRootCollection()
+	moved, err := tx.movePagesAbove(rootCollection, rootCollection.root, db.freelist.packedMaxPage())
+	if err != nil || !moved {
+		tx.rollback()
+		return high, err
+	}
+
+	return high, tx.Commit()
+}
+
+// truncate lowers the max page of the freelist to the highest page in use and truncates the file after it.
+func (db *DB) truncate() error {
+	err := db.flushSync()
+	if err != nil {
+		return err
+	}
+
+	tx := db.WriteTx()
+	if high := db.freelist.highestUsedPage(); high < db.maxPage {
+		maxPage, releasedPages := db.maxPage, slices.Clone(db.releasedPages)
+		db.freelist.truncate(high)
+		err = tx.commit()
+		if err != nil {
+			db.maxPage, db.releasedPages = maxPage, releasedPages
+			tx.rollback()
+			return fmt.Errorf("could not commit transaction: %w", err)
+		}
+	}
+	defer tx.close()
+
+	// The log may hold pages past the max page, written before they were moved, so it's checkpointed before the file is
+	// truncated. Otherwise, a later checkpoint would write them back.
+	err = db.checkpoint()
+	if err != nil {
+		return err
+	}
+
+	err = db.file.Truncate(int64(db.maxPage+1) * int64(db.pageSize))
+	if err != nil {
+		return err
+	}
+	if db.syncMode != SyncNone {
+		return fdatasync(db.file)
+	}
+	return nil
+}
+
+// movePagesAbove marks the nodes of the collection in pages past the given page, and the nodes holding values whose
+// overflow chain has such pages, as modified, so they are moved to free pages on commit. Nested collections are walked
+// as well. It returns whether there were any.
+func (tx *Tx) movePagesAbove(c *Collection, pgNum pageNum, last pageNum) (bool, error) {
+	node, err := tx.getNode(pgNum)
+	if err != nil {
+		return false, err
+	}
+
+	// The ancestors of a moved node are moved on commit as well, so only the node itself is marked
+	modified := pgNum > last
+	moved := false
+	for _, item := range node.items {
+		var itemMoved bool
+		if item.collection {
+			// Opening the nested collection tracks it, so its record is rewritten on commit if its root moves
+			nested, err := c.GetCollection(item.key)
+			if err != nil {
+				return false, err
+			}
+
+			itemMoved, err = tx.movePagesAbove(nested, nested.root, last)
+			if err != nil {
+				return false, err
+			}
+			moved = moved || itemMoved
+		} else if item.isOverflow() {
+			itemMoved, err = tx.moveOverflowAbove(item, last)
+			if err != nil {
+				return false, err
+			}
+			modified = modified || itemMoved
+		}
+	}
+
+	for _, child := range node.childNodes {
+		childMoved, err := tx.movePagesAbove(c, child, last)
+		if err != nil {
+			return false, err
+		}
+		moved = moved || childMoved
+	}
+
+	if modified {
+		tx.writeNode(node)
+	}
+	return moved || modified, nil
+}
+
+// moveOverflowAbove rewrites the overflow chain of an item into new pages if it has pages past the given page.
+func (tx *Tx) moveOverflowAbove(item *Item, last pageNum) (bool, error) {
+	above := false
+	err := tx.walkOverflow(item.overflowPage, item.overflowSize, func(pgNum pageNum, _ []byte) {
+		above = above || pgNum > last
+	})
+	if err != nil || !above {
+		return false, err
+	}
+
+	_, err = tx.loadValue(item)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.freeOverflow(item.overflowPage, item.overflowSize)
+	if err != nil {
+		return false, err
+	}
+	item.overflowPage = tx.writeOverflow(item.value)
+	return true, nil
+}
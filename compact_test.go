@@ -0,0 +1,356 @@
+package gonosql
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const compactTestKeys = 1000
+
+var compactTestNestedName = []byte("nested")
+
+// compactTestValue returns the value of a key put by fillCompactTestDB. Every tenth value is stored in overflow pages.
+func compactTestValue(db *DB, i int) []byte {
+	if i%10 == 0 {
+		return memset([]byte{byte(i)}, 2*db.pageSize)
+	}
+	return memset([]byte{byte(i)}, 100)
+}
+
+// fillCompactTestDB puts keys in a collection and in a collection nested in it, then removes most of them, so the file
+// is left with free pages all over it.
+func fillCompactTestDB(t *testing.T, db *DB) {
+	err := db.Update(func(tx *Tx) error {
+		collection, err := tx.CreateCollection(testCollectionName)
+		require.NoError(t, err)
+		nested, err := collection.CreateCollection(compactTestNestedName)
+		require.NoError(t, err)
+
+		for i := 0; i < compactTestKeys; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			require.NoError(t, collection.Put(key, compactTestValue(db, i)))
+			require.NoError(t, nested.Put(key, compactTestValue(db, i)))
+		}
+
+		for i := 0; i < 5; i++ {
+			collection.ID()
+		}
+		nested.ID()
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *Tx) error {
+		collection, err := tx.GetCollection(testCollectionName)
+		require.NoError(t, err)
+		nested, err := collection.GetCollection(compactTestNestedName)
+		require.NoError(t, err)
+
+		for i := 0; i < compactTestKeys; i++ {
+			if i%4 == 0 {
+				continue
+			}
+			key := []byte(fmt.Sprintf("key%04d", i))
+			require.NoError(t, collection.Remove(key))
+			require.NoError(t, nested.Remove(key))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// assertCompactTestDB checks that the database holds the keys left by fillCompactTestDB, and that it's consistent.
+func assertCompactTestDB(t *testing.T, db *DB) {
+	err := db.View(func(tx *Tx) error {
+		collection, err := tx.GetCollection(testCollectionName)
+		require.NoError(t, err)
+		require.NotNil(t, collection)
+		nested, err := collection.GetCollection(compactTestNestedName)
+		require.NoError(t, err)
+		require.NotNil(t, nested)
+		assert.Equal(t, uint64(5), collection.counter)
+		assert.Equal(t, uint64(1), nested.counter)
+
+		for _, c := range []*Collection{collection, nested} {
+			cursor := c.Cursor()
+			item, err := cursor.First()
+			for i := 0; i < compactTestKeys; i += 4 {
+				require.NoError(t, err)
+				require.NotNil(t, item)
+				assert.Equal(t, []byte(fmt.Sprintf("key%04d", i)), item.Key())
+				assert.True(t, bytes.Equal(compactTestValue(db, i), item.Value()), "key %d", i)
+				item, err = cursor.Next()
+			}
+			require.NoError(t, err)
+			if c == collection {
+				// The record of the nested collection comes after the keys
+				require.NotNil(t, item)
+				assert.True(t, item.IsCollection())
+				item, err = cursor.Next()
+				require.NoError(t, err)
+			}
+			assert.Nil(t, item)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	report, err := db.Check()
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	for _, warning := range report.Warnings {
+		assert.NotEqual(t, CheckPageLeaked, warning.Kind, warning.String())
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func TestDB_Compact(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+	fillCompactTestDB(t, db)
+
+	dst := getTempFileName()
+	defer os.Remove(dst)
+	require.NoError(t, db.Compact(dst))
+	assert.Less(t, fileSize(t, dst), fileSize(t, db.file.Name()))
+
+	compacted, err := Open(dst, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer compacted.Close()
+
+	assertCompactTestDB(t, compacted)
+	// Only the pages replaced by the last commit, the root of the root collection and the freelist, are free
+	report, err := compacted.Check()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, report.FreePages, 2)
+
+	// The source database is left as is
+	assertCompactTestDB(t, db)
+}
+
+func TestDB_CompactPacksNodes(t *testing.T) {
+	db, err := Open(getTempFileName(), &Options{MinFillPercent: 0.5, MaxFillPercent: 0.95})
+	require.NoError(t, err)
+	defer db.Close()
+	fillCompactTestDB(t, db)
+
+	dst := getTempFileName()
+	defer os.Remove(dst)
+	require.NoError(t, db.Compact(dst))
+
+	compacted, err := Open(dst, DefaultOptions)
+	require.NoError(t, err)
+	defer compacted.Close()
+
+	before, err := db.Check()
+	require.NoError(t, err)
+	after, err := compacted.Check()
+	require.NoError(t, err)
+	assert.Less(t, after.ReachablePages, before.ReachablePages)
+	assertCompactTestDB(t, compacted)
+
+	// Apart from the last node of every level, the nodes are filled past the min fill percent of the database
+	underPopulated := 0
+	for _, warning := range after.Warnings {
+		if warning.Kind == CheckNodeSize {
+			underPopulated++
+		}
+	}
+	assert.LessOrEqual(t, underPopulated, 4)
+}
+
+func TestDB_CompactSmallPages(t *testing.T) {
+	// On small pages, the min fill percent Compact raises is reached only by the last items of a node, if at all
+	db, err := Open(getTempFileName(), &Options{PageSize: minPageSize, MinFillPercent: 0.5, MaxFillPercent: 0.95})
+	require.NoError(t, err)
+	defer db.Close()
+
+	const keys = 2000
+	err = db.Update(func(tx *Tx) error {
+		collection, err := tx.CreateCollection(testCollectionName)
+		require.NoError(t, err)
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("%04d%s", i, memset([]byte{'k'}, 76+i*7%11))
+			require.NoError(t, collection.Put([]byte(key), memset([]byte{'v'}, 20)))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	dst := getTempFileName()
+	defer os.Remove(dst)
+	require.NoError(t, db.Compact(dst))
+
+	compacted, err := Open(dst, DefaultOptions)
+	require.NoError(t, err)
+	defer compacted.Close()
+
+	err = compacted.View(func(tx *Tx) error {
+		collection, err := tx.GetCollection(testCollectionName)
+		require.NoError(t, err)
+		stats, err := collection.Stats()
+		require.NoError(t, err)
+		assert.Equal(t, keys, stats.KeyCount)
+
+		count := 0
+		cursor := collection.Cursor()
+		for item, err := cursor.First(); item != nil; item, err = cursor.Next() {
+			require.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("%04d", count)), item.Key()[:4])
+			count++
+		}
+		assert.Equal(t, keys, count)
+		return nil
+	})
+	require.NoError(t, err)
+
+	report, err := compacted.Check()
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+func TestDB_CompactExistingDestination(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+	putTestItems(t, db, "0", "1")
+
+	dst := getTempFileName()
+	require.NoError(t, os.WriteFile(dst, []byte("data"), 0666))
+	defer os.Remove(dst)
+
+	err := db.Compact(dst)
+	assert.ErrorIs(t, err, os.ErrExist)
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+}
+
+func TestDB_CompactRemovesDestinationOnError(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+	fillCompactTestDB(t, db)
+
+	// The copy fails on the last leaf of the collection, once the other leaves were copied
+	root := testCollectionRoot(t, db)
+	corruptTestPage(t, path, root.childNodes[len(root.childNodes)-1])
+
+	dst := getTempFileName()
+	defer os.Remove(dst)
+	err = db.Compact(dst)
+	var corruptErr *ErrCorruptPage
+	assert.ErrorAs(t, err, &corruptErr)
+	_, err = os.Stat(dst)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDB_CompactInPlace(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *Options
+	}{
+		{name: "default", options: &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}},
+		{name: "wal", options: walTestOptions()},
+		{name: "sync group", options: &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage,
+			SyncMode: SyncGroup}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := getTempFileName()
+			db, err := Open(path, test.options)
+			require.NoError(t, err)
+			fillCompactTestDB(t, db)
+			require.NoError(t, db.Checkpoint())
+			before := fileSize(t, path)
+
+			require.NoError(t, db.CompactInPlace())
+			after := fileSize(t, path)
+			assert.Less(t, after, before/2)
+			assert.Equal(t, int64(db.maxPage+1)*int64(db.pageSize), after)
+
+			report, err := db.Check()
+			require.NoError(t, err)
+			assert.Less(t, report.FreePages, report.ReachablePages/10)
+			assertCompactTestDB(t, db)
+
+			// The database is still usable, and reopens in the same state
+			otherName, key := []byte("other"), []byte("key")
+			err = db.Update(func(tx *Tx) error {
+				collection, err := tx.CreateCollection(otherName)
+				require.NoError(t, err)
+				return collection.Put(key, compactTestValue(db, 0))
+			})
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+
+			db, err = Open(path, test.options)
+			require.NoError(t, err)
+			defer db.Close()
+			assertCompactTestDB(t, db)
+			err = db.View(func(tx *Tx) error {
+				collection, err := tx.GetCollection(otherName)
+				require.NoError(t, err)
+				item, err := collection.Find(key)
+				require.NoError(t, err)
+				require.NotNil(t, item)
+				assert.Equal(t, compactTestValue(db, 0), item.Value())
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDB_CompactInPlaceKeepsReadersSnapshot(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+	fillCompactTestDB(t, db)
+
+	tx := db.ReadTx()
+	require.NoError(t, db.CompactInPlace())
+
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	item, err := collection.Find([]byte("key0000"))
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	assert.Equal(t, compactTestValue(db, 0), item.Value())
+	require.NoError(t, tx.Rollback())
+
+	// Once the reader is done, the pages its snapshot held can be compacted as well
+	size := fileSize(t, db.file.Name())
+	require.NoError(t, db.CompactInPlace())
+	assert.Less(t, fileSize(t, db.file.Name()), size)
+	assertCompactTestDB(t, db)
+}
+
+func TestDB_CompactInPlaceReadOnly(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	fillCompactTestDB(t, db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.ErrorIs(t, db.CompactInPlace(), ErrDatabaseReadOnly)
+
+	// A read-only database can still be copied
+	dst := getTempFileName()
+	defer os.Remove(dst)
+	require.NoError(t, db.Compact(dst))
+}
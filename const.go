@@ -1,14 +1,62 @@
-package main
+package gonosql
 
 import "errors"
 
 const (
 	magicNumberSize = 4
-	counterSize     = 4
+	checksumSize    = 4
+	txIDSize        = 8
+	counterSize     = 8
 	nodeHeaderSize  = 3
+	offsetSize      = 2
+	itemFlagsSize   = 1
+	pageTypeSize    = 1
 
 	collectionSize = 16
 	pageNumSize    = 8
+
+	releasedCountSize      = 8
+	freelistPageHeaderSize = pageNumSize + releasedCountSize
 )
 
-var writeInsideReadTxErr = errors.New("can't perform a write operation inside a read transaction")
+const (
+	// itemFlagOverflow marks an item whose value is stored in a chain of overflow pages.
+	itemFlagOverflow byte = 1 << 0
+
+	// itemFlagCollection marks an item holding the record of a nested collection.
+	itemFlagCollection byte = 1 << 1
+)
+
+var (
+	ErrWriteInsideReadTx  = errors.New("can't perform a write operation inside a read transaction")
+	ErrKeyTooLarge        = errors.New("key is too large to fit in a page")
+	ErrValueTooLarge      = errors.New("value is too large to fit in a page")
+	ErrDatabaseReadOnly   = errors.New("can't perform a write operation on a database opened in read-only mode")
+	ErrCollectionExists   = errors.New("collection already exists")
+	ErrCollectionNotFound = errors.New("collection not found")
+	ErrIncompatibleValue  = errors.New("incompatible value: the key holds a collection where a value is expected or the other way around")
+
+	// ErrInvalidDatabase is returned by Open when the file isn't a database.
+	ErrInvalidDatabase = errors.New("invalid database: the file is not a gonosql database")
+
+	// ErrInvalidPageSize is returned by Open when Options.PageSize isn't a power of two between 512B and 64KB.
+	ErrInvalidPageSize = errors.New("invalid page size: it has to be a power of two between 512B and 64KB")
+
+	// ErrIncompatibleVersion is returned by Open when the database has a format version this package can't read, or
+	// can't upgrade.
+	ErrIncompatibleVersion = errors.New("incompatible database format version")
+
+	// ErrSavepointNotFound is returned when rolling back to or releasing a savepoint that was already released, was
+	// rolled back past, or belongs to another transaction.
+	ErrSavepointNotFound = errors.New("savepoint not found")
+
+	// ErrTxClosed is returned when using a transaction, or a collection or cursor obtained from it, after the
+	// transaction was committed or rolled back.
+	ErrTxClosed = errors.New("transaction is closed")
+
+	// ErrTxManaged is returned when committing a transaction run by DB.Update or DB.View.
+	ErrTxManaged = errors.New("can't commit a transaction managed by DB.Update or DB.View")
+
+	// ErrTimeout is returned by Open when the lock on the database file couldn't be taken within Options.LockTimeout.
+	ErrTimeout = errors.New("timeout while waiting for the database file lock")
+)
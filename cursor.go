@@ -0,0 +1,285 @@
+package gonosql
+
+// Cursor iterates over the items of a collection in key order. It's created by Collection.Cursor and is valid as long
+// as its transaction is. Inside a write transaction, the cursor sees the changes made by the transaction, but the
+// collection mustn't be modified while iterating, except by Cursor.Delete.
+type Cursor struct {
+	collection *Collection
+
+	// stack holds the path from the root to the current item. For the last element, index is the index of the
+	// current item in its node. For the others, it's the index of the child the path continues to. Since the items of
+	// a node are ordered between its children, the item at the same index follows that child.
+	stack []cursorElement
+
+	// deleted is set by Delete, after which the cursor is already positioned on the item following the deleted one.
+	deleted bool
+}
+
+type cursorElement struct {
+	node  *Node
+	index int
+}
+
+// Cursor returns a cursor over the items of the collection. The cursor isn't positioned until First, Last or Seek is
+// called.
+func (c *Collection) Cursor() *Cursor {
+	return &Cursor{collection: c}
+}
+
+// First moves the cursor to the first item of the collection and returns it. nil is returned if the collection is
+// empty.
+func (cur *Cursor) First() (*Item, error) {
+	if err := cur.collection.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	cur.deleted = false
+	cur.stack = cur.stack[:0]
+
+	root, err := cur.collection.tx.getNode(cur.collection.root)
+	if err != nil {
+		return nil, err
+	}
+	cur.stack = append(cur.stack, cursorElement{node: root})
+
+	err = cur.first()
+	if err != nil {
+		return nil, err
+	}
+	return cur.item()
+}
+
+// Last moves the cursor to the last item of the collection and returns it. nil is returned if the collection is empty.
+func (cur *Cursor) Last() (*Item, error) {
+	if err := cur.collection.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	cur.deleted = false
+	cur.stack = cur.stack[:0]
+
+	root, err := cur.collection.tx.getNode(cur.collection.root)
+	if err != nil {
+		return nil, err
+	}
+	cur.stack = append(cur.stack, cursorElement{node: root, index: len(root.items)})
+
+	err = cur.last()
+	if err != nil {
+		return nil, err
+	}
+	return cur.item()
+}
+
+// Seek moves the cursor to the given key, or to the item that follows it if the key doesn't exist, and returns the
+// item. nil is returned if there's no such item.
+func (cur *Cursor) Seek(key []byte) (*Item, error) {
+	if err := cur.collection.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	cur.deleted = false
+	cur.stack = cur.stack[:0]
+
+	root, err := cur.collection.tx.getNode(cur.collection.root)
+	if err != nil {
+		return nil, err
+	}
+
+	index, _, ancestorsIndexes, err := root.findKey(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := cur.collection.getNodes(ancestorsIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(nodes)-1; i++ {
+		cur.stack = append(cur.stack, cursorElement{node: nodes[i], index: ancestorsIndexes[i+1]})
+	}
+	cur.stack = append(cur.stack, cursorElement{node: nodes[len(nodes)-1], index: index})
+
+	// The key is bigger than all the items in the leaf, so the following item is in one of its ancestors
+	top := &cur.stack[len(cur.stack)-1]
+	if index == len(top.node.items) {
+		cur.popToNext()
+	}
+	return cur.item()
+}
+
+// Next moves the cursor to the next item and returns it. nil is returned once the cursor passes the last item.
+func (cur *Cursor) Next() (*Item, error) {
+	if err := cur.collection.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if cur.deleted {
+		cur.deleted = false
+		return cur.item()
+	}
+
+	if len(cur.stack) == 0 {
+		return nil, nil
+	}
+
+	top := &cur.stack[len(cur.stack)-1]
+	top.index++
+
+	// In an internal node, the next item is the first one of the child that follows the current item
+	if !top.node.isLeaf() {
+		err := cur.first()
+		if err != nil {
+			return nil, err
+		}
+		return cur.item()
+	}
+
+	if top.index == len(top.node.items) {
+		cur.popToNext()
+	}
+	return cur.item()
+}
+
+// Prev moves the cursor to the previous item and returns it. nil is returned once the cursor passes the first item.
+func (cur *Cursor) Prev() (*Item, error) {
+	if err := cur.collection.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if cur.deleted {
+		cur.deleted = false
+
+		// The deleted item was the last one, so the previous item is the last item left
+		if len(cur.stack) == 0 {
+			return cur.Last()
+		}
+	}
+
+	if len(cur.stack) == 0 {
+		return nil, nil
+	}
+
+	// In an internal node, the previous item is the last one of the child that precedes the current item
+	top := &cur.stack[len(cur.stack)-1]
+	if !top.node.isLeaf() {
+		err := cur.last()
+		if err != nil {
+			return nil, err
+		}
+		return cur.item()
+	}
+
+	top.index--
+	if top.index < 0 {
+		cur.popToPrev()
+	}
+	return cur.item()
+}
+
+// Delete removes the current item from the collection. The cursor stays valid: Next returns the item that followed the
+// deleted one, and Prev the item that preceded it.
+func (cur *Cursor) Delete() error {
+	if err := cur.collection.tx.checkOpen(); err != nil {
+		return err
+	}
+
+	if len(cur.stack) == 0 || cur.deleted {
+		return nil
+	}
+
+	top := cur.stack[len(cur.stack)-1]
+	key := top.node.items[top.index].key
+	err := cur.collection.Remove(key)
+	if err != nil {
+		return err
+	}
+
+	// Removing the item may have re-balanced the tree, so the path to the following item is looked up again
+	_, err = cur.Seek(key)
+	if err != nil {
+		return err
+	}
+
+	cur.deleted = true
+	return nil
+}
+
+// first descends from the current element to the first item of the subtree it points to. If the subtree ends in an
+// empty leaf, the cursor moves up to the item following it.
+func (cur *Cursor) first() error {
+	for {
+		top := cur.stack[len(cur.stack)-1]
+		if top.node.isLeaf() {
+			if len(top.node.items) == 0 {
+				cur.popToNext()
+			}
+			return nil
+		}
+
+		child, err := cur.collection.tx.getNode(top.node.childNodes[top.index])
+		if err != nil {
+			return err
+		}
+		cur.stack = append(cur.stack, cursorElement{node: child})
+	}
+}
+
+// last descends from the current element to the last item of the subtree preceding it. If the subtree ends in an
+// empty leaf, the cursor moves up to the item preceding it.
+func (cur *Cursor) last() error {
+	for {
+		top := &cur.stack[len(cur.stack)-1]
+		if top.node.isLeaf() {
+			top.index = len(top.node.items) - 1
+			if top.index < 0 {
+				cur.popToPrev()
+			}
+			return nil
+		}
+
+		child, err := cur.collection.tx.getNode(top.node.childNodes[top.index])
+		if err != nil {
+			return err
+		}
+		cur.stack = append(cur.stack, cursorElement{node: child, index: len(child.items)})
+	}
+}
+
+// popToNext leaves a node whose items were all visited, going up to the first ancestor with an item after the child
+// the path went through. The stack is emptied if there's none.
+func (cur *Cursor) popToNext() {
+	cur.stack = cur.stack[:len(cur.stack)-1]
+	for len(cur.stack) > 0 {
+		top := cur.stack[len(cur.stack)-1]
+		if top.index < len(top.node.items) {
+			return
+		}
+		cur.stack = cur.stack[:len(cur.stack)-1]
+	}
+}
+
+// popToPrev leaves a node whose items were all visited backwards, going up to the first ancestor with an item before
+// the child the path went through. The stack is emptied if there's none.
+func (cur *Cursor) popToPrev() {
+	cur.stack = cur.stack[:len(cur.stack)-1]
+	for len(cur.stack) > 0 {
+		top := &cur.stack[len(cur.stack)-1]
+		if top.index > 0 {
+			top.index--
+			return
+		}
+		cur.stack = cur.stack[:len(cur.stack)-1]
+	}
+}
+
+// item returns the current item, with its value loaded.
+func (cur *Cursor) item() (*Item, error) {
+	if len(cur.stack) == 0 {
+		return nil, nil
+	}
+
+	top := cur.stack[len(cur.stack)-1]
+	return cur.collection.tx.loadValue(top.node.items[top.index])
+}
@@ -0,0 +1,308 @@
+package gonosql
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cursorTestKeys are enough keys to build a tree three levels deep
+var cursorTestKeys = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f", "g", "h",
+	"i", "j", "k", "l", "m", "n", "o", "p", "q", "r", "s", "t", "u", "v", "w", "x", "y", "z"}
+
+func createTestCursorCollection(t *testing.T, db *DB) (*Tx, *Collection) {
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	// Insert out of order
+	for i := range cursorTestKeys {
+		key := cursorTestKeys[(i*7)%len(cursorTestKeys)]
+		err = collection.Put(createItem(key), createItem(key))
+		require.NoError(t, err)
+	}
+
+	return tx, collection
+}
+
+func cursorKeys(t *testing.T, item *Item, err error, next func() (*Item, error)) []string {
+	keys := make([]string, 0)
+	for ; item != nil; item, err = next() {
+		require.NoError(t, err)
+		assert.Equal(t, item.Key(), item.Value())
+		keys = append(keys, string(item.Key()[:1]))
+	}
+	require.NoError(t, err)
+	return keys
+}
+
+func TestCursor_Forward(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	// The cursor sees the uncommitted nodes of the write transaction
+	tx, collection := createTestCursorCollection(t, db)
+	rootNode, err := tx.getNode(collection.root)
+	require.NoError(t, err)
+	require.False(t, rootNode.isLeaf())
+
+	cursor := collection.Cursor()
+	item, err := cursor.First()
+	assert.Equal(t, cursorTestKeys, cursorKeys(t, item, err, cursor.Next))
+	require.NoError(t, tx.Commit())
+
+	tx = db.ReadTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	cursor = collection.Cursor()
+	item, err = cursor.First()
+	assert.Equal(t, cursorTestKeys, cursorKeys(t, item, err, cursor.Next))
+
+	// Past the end
+	item, err = cursor.Next()
+	require.NoError(t, err)
+	assert.Nil(t, item)
+	require.NoError(t, tx.Commit())
+}
+
+func TestCursor_Backward(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection := createTestCursorCollection(t, db)
+	defer tx.Rollback()
+
+	expected := slices.Clone(cursorTestKeys)
+	slices.Reverse(expected)
+
+	cursor := collection.Cursor()
+	item, err := cursor.Last()
+	assert.Equal(t, expected, cursorKeys(t, item, err, cursor.Prev))
+
+	item, err = cursor.Prev()
+	require.NoError(t, err)
+	assert.Nil(t, item)
+}
+
+func TestCursor_NextAndPrev(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection := createTestCursorCollection(t, db)
+	defer tx.Rollback()
+
+	// Go back and forth over every item, crossing between leaves and internal nodes
+	cursor := collection.Cursor()
+	item, err := cursor.First()
+	require.NoError(t, err)
+	for i := 1; i < len(cursorTestKeys); i++ {
+		item, err = cursor.Next()
+		require.NoError(t, err)
+		assert.Equal(t, createItem(cursorTestKeys[i]), item.Key())
+
+		item, err = cursor.Prev()
+		require.NoError(t, err)
+		assert.Equal(t, createItem(cursorTestKeys[i-1]), item.Key())
+
+		item, err = cursor.Next()
+		require.NoError(t, err)
+		assert.Equal(t, createItem(cursorTestKeys[i]), item.Key())
+	}
+}
+
+func TestCursor_Seek(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection := createTestCursorCollection(t, db)
+	defer tx.Rollback()
+
+	cursor := collection.Cursor()
+	for i, key := range cursorTestKeys {
+		item, err := cursor.Seek(createItem(key))
+		require.NoError(t, err)
+		assert.Equal(t, createItem(key), item.Key())
+
+		// A key between two items is followed by the bigger one
+		item, err = cursor.Seek(append(createItem(key), 0))
+		require.NoError(t, err)
+		if i == len(cursorTestKeys)-1 {
+			assert.Nil(t, item)
+		} else {
+			assert.Equal(t, createItem(cursorTestKeys[i+1]), item.Key())
+		}
+	}
+
+	item, err := cursor.Seek([]byte(""))
+	require.NoError(t, err)
+	assert.Equal(t, createItem("0"), item.Key())
+
+	item, err = cursor.Seek(createItem("5"))
+	require.NoError(t, err)
+	assert.Equal(t, cursorTestKeys[6:], cursorKeys(t, item, err, cursor.Next)[1:])
+
+	item, err = cursor.Seek(createItem("5"))
+	require.NoError(t, err)
+	item, err = cursor.Prev()
+	require.NoError(t, err)
+	assert.Equal(t, createItem("4"), item.Key())
+}
+
+func TestCursor_EmptyCollection(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	defer tx.Rollback()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	cursor := collection.Cursor()
+	for _, move := range []func() (*Item, error){cursor.First, cursor.Last, cursor.Next, cursor.Prev} {
+		item, err := move()
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	}
+
+	item, err := cursor.Seek([]byte("key"))
+	require.NoError(t, err)
+	assert.Nil(t, item)
+}
+
+// cursorTestLeaves returns the leaves of the tree under the given page, in key order.
+func cursorTestLeaves(t *testing.T, db *DB, pgNum pageNum) []pageNum {
+	node, err := db.getNode(pgNum)
+	require.NoError(t, err)
+	if node.isLeaf() {
+		return []pageNum{pgNum}
+	}
+
+	var leaves []pageNum
+	for _, child := range node.childNodes {
+		leaves = append(leaves, cursorTestLeaves(t, db, child)...)
+	}
+	return leaves
+}
+
+func TestCursor_EmptyLeaves(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection := createTestCursorCollection(t, db)
+	root := collection.root
+	require.NoError(t, tx.Commit())
+
+	// Empty the first and the last leaves, and two leaves next to each other in between
+	leaves := cursorTestLeaves(t, db, root)
+	require.Greater(t, len(leaves), 4)
+	removed := make(map[string]bool)
+	for _, leaf := range []pageNum{leaves[0], leaves[len(leaves)/2], leaves[len(leaves)/2+1], leaves[len(leaves)-1]} {
+		rewriteTestNode(t, db, leaf, func(node *Node) {
+			for _, item := range node.items {
+				removed[string(item.key[:1])] = true
+			}
+			node.items = nil
+		})
+	}
+
+	expected := make([]string, 0)
+	for _, key := range cursorTestKeys {
+		if !removed[key] {
+			expected = append(expected, key)
+		}
+	}
+
+	tx = db.ReadTx()
+	defer tx.Rollback()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	cursor := collection.Cursor()
+	item, err := cursor.First()
+	assert.Equal(t, expected, cursorKeys(t, item, err, cursor.Next))
+
+	item, err = cursor.Last()
+	backward := cursorKeys(t, item, err, cursor.Prev)
+	slices.Reverse(backward)
+	assert.Equal(t, expected, backward)
+
+	// Seeking a key of an emptied leaf moves to the item following it
+	for _, key := range cursorTestKeys {
+		if !removed[key] {
+			continue
+		}
+
+		item, err = cursor.Seek(createItem(key))
+		require.NoError(t, err)
+		next, _ := slices.BinarySearch(expected, key)
+		if next == len(expected) {
+			assert.Nil(t, item)
+		} else {
+			require.NotNil(t, item)
+			assert.Equal(t, createItem(expected[next]), item.Key())
+		}
+	}
+}
+
+func TestCursor_Delete(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection := createTestCursorCollection(t, db)
+
+	// Delete every other item while iterating, re-balancing the tree along the way
+	expected := make([]string, 0)
+	cursor := collection.Cursor()
+	item, err := cursor.First()
+	for i := 0; item != nil; i++ {
+		require.NoError(t, err)
+		if i%2 == 0 {
+			require.NoError(t, cursor.Delete())
+		} else {
+			expected = append(expected, string(item.Key()[:1]))
+		}
+		item, err = cursor.Next()
+	}
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	tx = db.WriteTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	cursor = collection.Cursor()
+	item, err = cursor.First()
+	assert.Equal(t, expected, cursorKeys(t, item, err, cursor.Next))
+
+	// Prev after Delete returns the item preceding the deleted one
+	item, err = cursor.Seek(createItem("3"))
+	require.NoError(t, err)
+	require.NoError(t, cursor.Delete())
+	item, err = cursor.Prev()
+	require.NoError(t, err)
+	assert.Equal(t, createItem("1"), item.Key())
+
+	// Deleting the last item
+	_, err = cursor.Last()
+	require.NoError(t, err)
+	require.NoError(t, cursor.Delete())
+	item, err = cursor.Prev()
+	require.NoError(t, err)
+	assert.Equal(t, createItem(expected[len(expected)-2]), item.Key())
+
+	// Deleting everything backwards
+	item, err = cursor.Last()
+	for ; item != nil; item, err = cursor.Prev() {
+		require.NoError(t, err)
+		require.NoError(t, cursor.Delete())
+	}
+	require.NoError(t, err)
+
+	item, err = cursor.First()
+	require.NoError(t, err)
+	assert.Nil(t, item)
+	require.NoError(t, tx.Commit())
+}
@@ -1,18 +1,62 @@
-package main
+package gonosql
 
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"time"
 )
 
 type pageNum uint64
 
 type Options struct {
-	pageSize int
+	// PageSize is the size of the pages of a new database, in bytes. It has to be a power of two between 512B and 64KB.
+	// When it's zero, the page size of the system is used. An existing database always keeps the page size it was
+	// created with, which is stored in its meta page.
+	PageSize int
 
 	MinFillPercent float32
 	MaxFillPercent float32
+
+	// MaxInlineValueSize is the biggest value stored inside a node. Bigger values are stored in overflow pages, and so
+	// are values that don't fit in a node with their key. When it's zero, an eighth of the page size is used.
+	MaxInlineValueSize int
+
+	// WAL makes transactions append their pages to a write-ahead log next to the database file instead of writing them
+	// into the database file. The log is copied into the database file on checkpoints.
+	WAL bool
+
+	// WALCheckpointSize is the size in bytes the log may grow to before it's checkpointed on commit. When it's zero,
+	// the log is checkpointed once it holds 1000 pages. When it's negative, the log is checkpointed only by calling
+	// DB.Checkpoint or when the database is closed.
+	WALCheckpointSize int64
+
+	// SyncMode sets when commits are synced to the disk. It's SyncAlways by default.
+	SyncMode SyncMode
+
+	// GroupCommitDelay is the longest a commit waits to be synced in SyncGroup mode. When it's zero, 10ms are used.
+	GroupCommitDelay time.Duration
+
+	// ReadOnly opens the database for reading only. The database file is locked in shared mode, so other read-only
+	// processes can open it at the same time, but no writer can.
+	ReadOnly bool
+
+	// LockTimeout is how long Open waits for the lock on the database file held by another process before it fails
+	// with ErrTimeout. When it's zero, Open waits until the lock is released.
+	LockTimeout time.Duration
+
+	// DebugTx records the stack of the goroutine starting every transaction, and reports the transactions left open
+	// longer than TxLeakThreshold. It's meant for finding transactions that are never committed or rolled back.
+	DebugTx bool
+
+	// TxLeakThreshold is how long a transaction may stay open in debug mode before it's reported. When it's zero, 10s
+	// are used.
+	TxLeakThreshold time.Duration
+
+	// OnTxLeak is called in debug mode with every transaction left open longer than TxLeakThreshold. When it's nil,
+	// the transaction is logged.
+	OnTxLeak func(leak *TxLeak)
 }
 
 var DefaultOptions = &Options{
@@ -26,10 +70,29 @@ type page struct {
 }
 
 type dal struct {
-	pageSize       int
-	minFillPercent float32
-	maxFillPercent float32
-	file           *os.File
+	pageSize           int
+	minFillPercent     float32
+	maxFillPercent     float32
+	maxInlineValueSize int
+	file               *os.File
+
+	// the write-ahead log, used only in WAL mode
+	wal               *wal
+	walCheckpointSize int64
+
+	syncMode SyncMode
+	readOnly bool
+
+	// writeHook, when set, is called before every step of writing a commit, and the step fails with the error it
+	// returns. It's used by tests to inject write failures.
+	writeHook func(step writeStep) error
+
+	// syncer syncs the commits in the background, used only in SyncGroup mode.
+	syncer *groupSyncer
+
+	// pages released by commits that may still be read, either by an open read transaction or, in SyncGroup mode,
+	// through the meta page on the disk until the commit is synced. See releaseCommittedPages.
+	pendingPages []pendingPages
 
 	*meta
 	*freelist
@@ -37,60 +100,185 @@ type dal struct {
 
 func newDal(path string, options *Options) (*dal, error) {
 	dal := &dal{
-		meta:           newEmptyMeta(),
-		pageSize:       options.pageSize,
-		minFillPercent: options.MinFillPercent,
-		maxFillPercent: options.MaxFillPercent,
+		meta:               newEmptyMeta(),
+		pageSize:           options.PageSize,
+		minFillPercent:     options.MinFillPercent,
+		maxFillPercent:     options.MaxFillPercent,
+		maxInlineValueSize: options.MaxInlineValueSize,
+		walCheckpointSize:  options.WALCheckpointSize,
+		syncMode:           options.SyncMode,
+		readOnly:           options.ReadOnly,
+	}
+	if dal.pageSize == 0 {
+		dal.pageSize = os.Getpagesize()
+	}
+	if !isValidPageSize(dal.pageSize) {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidPageSize, dal.pageSize)
 	}
 
-	// exist
-	if _, err := os.Stat(path); err == nil {
-		dal.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			_ = dal.close()
-			return nil, err
-		}
+	err := dal.open(path, options)
+	if err != nil {
+		_ = dal.close()
+		return nil, err
+	}
 
-		meta, err := dal.readMeta()
-		if err != nil {
-			return nil, err
-		}
-		dal.meta = meta
+	// The page size is known only once the file is opened
+	if dal.walCheckpointSize == 0 {
+		dal.walCheckpointSize = defaultWALCheckpointPages * frameSize(dal.pageSize)
+	}
 
-		freelist, err := dal.readFreelist()
-		if err != nil {
-			return nil, err
-		}
-		dal.freelist = freelist
-		// doesn't exist
-	} else if errors.Is(err, os.ErrNotExist) {
-		// init freelist
-		dal.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			_ = dal.close()
-			return nil, err
+	return dal, nil
+}
+
+// open opens and locks the database file. Writers lock it exclusively, so no other process can open it, while
+// read-only openers share the lock with each other. An empty file is initialized as a new database.
+func (d *dal) open(path string, options *Options) error {
+	flag := os.O_RDWR | os.O_CREATE
+	if d.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(path, flag, 0666)
+	if err != nil {
+		return err
+	}
+	d.file = file
+
+	err = flock(d.file, !d.readOnly, options.LockTimeout)
+	if err != nil {
+		return err
+	}
+
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		if d.readOnly {
+			return ErrDatabaseReadOnly
 		}
 
-		dal.freelist = newFreelist()
-		dal.freelistPage = dal.getNextPage()
-		_, err := dal.writeFreelist()
+		err = d.initialize()
+	} else {
+		d.pageSize, err = readPageSize(d.file)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		err = d.load(path)
+	}
+	if err != nil {
+		return err
+	}
 
-		// init root
-		collectionsNode, err := dal.writeNode(NewNodeForSerialization([]*Item{}, []pageNum{}))
+	if options.WAL && !d.readOnly {
+		wal, err := openWAL(walPath(path), d.pageSize)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		dal.root = collectionsNode.pgNum
+		d.wal = wal
+	}
 
-		// write meta page
-		_, err = dal.writeMeta(dal.meta) // other error
+	if d.syncMode == SyncGroup && !d.readOnly {
+		d.syncer = newGroupSyncer(options.GroupCommitDelay, d.txid, d.syncGroup)
+	}
+
+	return nil
+}
+
+// load reads the meta and the freelist of an existing database. A log left by a previous run is replayed first, or
+// only read through in read-only mode.
+func (d *dal) load(path string) error {
+	var err error
+	if d.readOnly {
+		if _, statErr := os.Stat(walPath(path)); statErr == nil {
+			d.wal, err = openWALReadOnly(walPath(path), d.pageSize)
+		}
 	} else {
-		return nil, err
+		err = d.recoverWAL(path)
 	}
-	return dal, nil
+	if err != nil {
+		return err
+	}
+
+	meta, err := d.readMeta()
+	if err != nil {
+		return err
+	}
+	d.meta = meta
+
+	err = d.meta.checkVersion()
+	if err != nil {
+		return err
+	}
+
+	freelist, err := d.readFreelist()
+	if err != nil {
+		return err
+	}
+	d.freelist = freelist
+
+	return d.upgrade()
+}
+
+// initialize writes an empty database into the file: the meta page, the freelist and the root collection.
+func (d *dal) initialize() error {
+	// init freelist
+	d.freelist = newFreelist()
+	d.freelistPage = d.getNextPage()
+	d.freelist.pages = []pageNum{d.freelistPage}
+
+	// init root
+	collectionsNode, err := d.writeNode(NewNodeForSerialization([]*Item{}, []pageNum{}))
+	if err != nil {
+		return err
+	}
+	d.root = collectionsNode.pgNum
+
+	// The freelist is written last, so it covers the pages allocated above
+	err = d.writeFreelist(d.freelist.pages, d.freelist)
+	if err != nil {
+		return err
+	}
+
+	// write meta page
+	d.version = formatVersion
+	d.meta.pageSize = uint32(d.pageSize)
+	_, err = d.writeMeta(d.meta)
+	if err != nil {
+		return err
+	}
+
+	if d.syncMode != SyncNone {
+		return fdatasync(d.file)
+	}
+	return nil
+}
+
+// recoverWAL replays a log left by a previous run into the database file, whether the database is opened in WAL mode
+// or not. Transactions that didn't finish appending to the log before a crash are discarded.
+func (d *dal) recoverWAL(path string) error {
+	if _, err := os.Stat(walPath(path)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	w, err := openWAL(walPath(path), d.pageSize)
+	if err != nil {
+		return err
+	}
+
+	err = w.checkpoint(d.file)
+	if err != nil {
+		_ = w.close()
+		return err
+	}
+
+	err = w.close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(walPath(path))
 }
 
 // getSplitIndex should be called when performing re-balance after an item is removed. It checks if a node can spare an
@@ -112,8 +300,13 @@ func (d *dal) getSplitIndex(node *Node) int {
 	return -1
 }
 
+// bodySize returns the size of the content of a page, after its header.
+func (d *dal) bodySize() int {
+	return d.pageSize - pageHeaderSize
+}
+
 func (d *dal) maxThreshold() float32 {
-	return d.maxFillPercent * float32(d.pageSize)
+	return d.maxFillPercent * float32(d.bodySize())
 }
 
 func (d *dal) isOverPopulated(node *Node) bool {
@@ -121,15 +314,63 @@ func (d *dal) isOverPopulated(node *Node) bool {
 }
 
 func (d *dal) minThreshold() float32 {
-	return d.minFillPercent * float32(d.pageSize)
+	return d.minFillPercent * float32(d.bodySize())
 }
 
 func (d *dal) isUnderPopulated(node *Node) bool {
 	return float32(node.nodeSize()) < d.minThreshold()
 }
 
+// maxItemSize returns the maximum size of a key-value pair inside a node. Items are capped at a quarter of a page so a
+// split always leaves both halves small enough to fit in their pages.
+func (d *dal) maxItemSize() int {
+	return d.bodySize() / 4
+}
+
+// inlineValueThreshold returns the biggest value that is stored inside a node instead of in overflow pages.
+func (d *dal) inlineValueThreshold() int {
+	if d.maxInlineValueSize > 0 {
+		return d.maxInlineValueSize
+	}
+	return d.pageSize / 8
+}
+
 func (d *dal) close() error {
+	if d.syncer != nil {
+		err := d.syncer.close()
+		if err != nil {
+			return err
+		}
+		d.syncer = nil
+	}
+
+	if d.wal != nil {
+		// A read-only database leaves the log to the next writer
+		if !d.readOnly {
+			err := d.checkpoint()
+			if err != nil {
+				return err
+			}
+		}
+
+		err := d.wal.close()
+		if err != nil {
+			return err
+		}
+
+		if !d.readOnly {
+			err = os.Remove(d.wal.file.Name())
+			if err != nil {
+				return err
+			}
+		}
+		d.wal = nil
+	}
+
 	if d.file != nil {
+		// Closing the file releases the lock as well, the lock is released first to make it explicit
+		_ = funlock(d.file)
+
 		err := d.file.Close()
 		if err != nil {
 			return fmt.Errorf("could not close file: %s", err)
@@ -148,6 +389,17 @@ func (d *dal) allocateEmptyPage() *page {
 
 func (d *dal) readPage(pgNum pageNum) (*page, error) {
 	p := d.allocateEmptyPage()
+	p.num = pgNum
+
+	if d.wal != nil {
+		ok, err := d.wal.readPage(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return p, nil
+		}
+	}
 
 	offset := int(pgNum) * d.pageSize
 	_, err := d.file.ReadAt(p.data, int64(offset))
@@ -165,30 +417,286 @@ func (d *dal) writePage(p *page) error {
 	return err
 }
 
+// writeStep is a step of writing a commit to the disk.
+type writeStep int
+
+const (
+	writeStepPage writeStep = iota
+	writeStepBarrier
+	writeStepMeta
+	writeStepWAL
+	writeStepSync
+)
+
+// beforeWrite is called before every step of writing a commit. It returns the error of the write hook, if it's set.
+func (d *dal) beforeWrite(step writeStep) error {
+	if d.writeHook == nil {
+		return nil
+	}
+	return d.writeHook(step)
+}
+
+// writeCommit writes the pages of a transaction and then its meta page, and syncs them according to the sync mode. In
+// WAL mode, they are appended to the log instead. Outside of WAL mode in SyncGroup mode, only the pages are written,
+// and the meta page is left to the background sync. If writing fails, the commit is undone as far as possible, so the
+// database stays in the state of the previous commit: the frames appended to the log are truncated, and a meta page
+// that was written is invalidated.
+func (d *dal) writeCommit(pages map[pageNum]*page, meta *meta) error {
+	metaPage := d.serializeMeta(meta)
+
+	if d.wal != nil {
+		walPages := make([]*page, 0, len(pages))
+		for _, p := range pages {
+			walPages = append(walPages, p)
+		}
+
+		// The log needs no write barrier. Recovery stops at the first frame with a bad checksum, so the meta frame
+		// is never replayed without the frames before it.
+		err := d.beforeWrite(writeStepWAL)
+		if err != nil {
+			return err
+		}
+		frames, err := d.wal.append(walPages, metaPage, meta.txid)
+		if err != nil {
+			d.wal.discard()
+			return err
+		}
+
+		err = d.syncCommit(meta)
+		if err != nil {
+			d.wal.discard()
+			return err
+		}
+
+		d.wal.publish(frames)
+		return nil
+	}
+
+	for _, p := range pages {
+		err := d.beforeWrite(writeStepPage)
+		if err == nil {
+			err = d.writePage(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// In SyncGroup mode, the write barrier and the meta page are left to the background sync, see syncGroup
+	if d.syncMode == SyncGroup {
+		return d.syncCommit(meta)
+	}
+
+	// Write barrier: the pages have to reach the disk before the meta page pointing to them. Otherwise, the disk may
+	// reorder the writes and a crash would leave a meta page referencing pages that were never written.
+	if d.syncMode != SyncNone {
+		err := d.beforeWrite(writeStepBarrier)
+		if err == nil {
+			err = fdatasync(d.file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := d.beforeWrite(writeStepMeta)
+	if err != nil {
+		return err
+	}
+	err = d.writePage(metaPage)
+	if err == nil {
+		err = d.syncCommit(meta)
+	}
+	if err != nil {
+		// The meta page may have reached the file. Zeroing it makes the previous meta page the latest valid one again.
+		_ = d.writePage(&page{num: metaPage.num, data: make([]byte, d.pageSize)})
+		return err
+	}
+	return nil
+}
+
+// autoCheckpoint checkpoints the log once it grows past its size limit. It does nothing outside of WAL mode.
+func (d *dal) autoCheckpoint() error {
+	if d.wal != nil && d.walCheckpointSize > 0 && d.wal.size >= d.walCheckpointSize {
+		return d.checkpoint()
+	}
+	return nil
+}
+
+// syncCommit syncs a commit that was just written according to the sync mode.
+func (d *dal) syncCommit(meta *meta) error {
+	switch d.syncMode {
+	case SyncAlways:
+		err := d.beforeWrite(writeStepSync)
+		if err != nil {
+			return err
+		}
+		return d.syncFile()
+	case SyncGroup:
+		// The meta of the database changes with the next commit, so the syncer keeps a copy
+		committed := *meta
+		return d.syncer.commit(&committed)
+	default:
+		return nil
+	}
+}
+
+// syncFile syncs the file commits are written to, which is the log in WAL mode.
+func (d *dal) syncFile() error {
+	if d.wal != nil {
+		return fdatasync(d.wal.file)
+	}
+	return fdatasync(d.file)
+}
+
+// syncGroup syncs a batch of commits in SyncGroup mode and returns the id of the latest commit on the disk. In WAL
+// mode, the commits are in the log already, which only has to be synced. Otherwise, their pages were written without
+// their meta pages: the pages are synced first, as a write barrier, and then the meta page of the latest commit is
+// written and synced, so a batch takes two syncs however many commits it has.
+func (d *dal) syncGroup(synced uint64, metas []*meta) (uint64, error) {
+	latest := metas[len(metas)-1]
+	if d.wal != nil {
+		err := d.beforeWrite(writeStepSync)
+		if err == nil {
+			err = d.syncFile()
+		}
+		if err != nil {
+			return synced, err
+		}
+		return latest.txid, nil
+	}
+
+	err := d.beforeWrite(writeStepBarrier)
+	if err == nil {
+		err = fdatasync(d.file)
+	}
+	if err != nil {
+		return synced, err
+	}
+
+	// The meta pages alternate between transactions, so the meta page of the latest commit may be the one of the synced
+	// commit, which is the only valid meta page if the write is torn. The commit before the latest one is made durable
+	// first in the other meta page then. Its pages are intact, since the pages it freed are still pending.
+	if latest.pageNum() == pageNum(synced%metaPagesCount) {
+		previous := metas[len(metas)-2]
+		err = d.writeSyncedMeta(previous)
+		if err != nil {
+			return synced, err
+		}
+		synced = previous.txid
+	}
+
+	err = d.writeSyncedMeta(latest)
+	if err != nil {
+		return synced, err
+	}
+	return latest.txid, nil
+}
+
+// writeSyncedMeta writes and syncs the meta page of a commit in SyncGroup mode. If it fails, the meta page is
+// invalidated like in writeCommit.
+func (d *dal) writeSyncedMeta(meta *meta) error {
+	err := d.beforeWrite(writeStepMeta)
+	if err == nil {
+		_, err = d.writeMeta(meta)
+	}
+	if err == nil {
+		err = d.beforeWrite(writeStepSync)
+	}
+	if err == nil {
+		err = fdatasync(d.file)
+	}
+	if err != nil {
+		_ = d.writePage(&page{num: meta.pageNum(), data: make([]byte, d.pageSize)})
+	}
+	return err
+}
+
+// flushSync syncs the commits that weren't synced yet, so the pages they freed can be reused. It does nothing outside
+// of SyncGroup mode.
+func (d *dal) flushSync() error {
+	if d.syncer == nil {
+		return nil
+	}
+	return d.syncer.flush()
+}
+
+// releaseCommittedPages releases the pages freed by a commit. They stay pending as long as they may still be read:
+// by read transactions started before the commit, which read the tree it replaced, and in SyncGroup mode until the
+// commit is synced, since until then a crash brings back the previous meta page, which still references them.
+func (d *dal) releaseCommittedPages(txid uint64, pages []pageNum, oldestReader uint64) {
+	d.pendingPages = append(d.pendingPages, pendingPages{txid: txid, pages: pages})
+	d.releasePendingPages(oldestReader)
+}
+
+// releasePendingPages releases the pending pages that can't be read anymore. oldestReader is the txid of the snapshot
+// read by the oldest open read transaction, or noReaders if there's none. The pages freed by a commit are read only by
+// snapshots older than the commit.
+func (d *dal) releasePendingPages(oldestReader uint64) {
+	releasable := oldestReader
+	if d.syncer != nil {
+		releasable = min(releasable, d.syncer.synced())
+	}
+
+	i := 0
+	for ; i < len(d.pendingPages) && d.pendingPages[i].txid <= releasable; i++ {
+		for _, pgNum := range d.pendingPages[i].pages {
+			d.releasePage(pgNum)
+		}
+	}
+	d.pendingPages = d.pendingPages[i:]
+}
+
+// committedFreelist returns the freelist as it's persisted by a commit releasing the given pages. Pending pages are
+// free as well from the point of view of the new meta page.
+func (d *dal) committedFreelist(pages []pageNum) *freelist {
+	released := make([]pageNum, 0, len(pages))
+	for _, pending := range d.pendingPages {
+		released = append(released, pending.pages...)
+	}
+	released = append(released, pages...)
+
+	return d.freelist.withReleasedPages(released)
+}
+
+// checkpoint copies the pages in the log to the database file. It does nothing outside of WAL mode.
+func (d *dal) checkpoint() error {
+	if d.wal == nil {
+		return nil
+	}
+	if d.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	return d.wal.checkpoint(d.file)
+}
+
 func (d *dal) getNode(pgNum pageNum) (*Node, error) {
 	p, err := d.readPage(pgNum)
 	if err != nil {
 		return nil, err
 	}
 
+	err = p.verify(pageTypeNode)
+	if err != nil {
+		return nil, err
+	}
+
 	node := NewEmptyNode()
-	node.deserialize(p.data)
+	err = node.deserialize(p.body())
+	if err != nil {
+		return nil, &ErrCorruptPage{PageNum: uint64(pgNum), Reason: err.Error()}
+	}
 	node.pgNum = pgNum
 	return node, nil
 }
 
 func (d *dal) writeNode(n *Node) (*Node, error) {
-	p := d.allocateEmptyPage()
 	if n.pgNum == 0 {
-		p.num = d.getNextPage()
-		n.pgNum = p.num
-	} else {
-		p.num = n.pgNum
+		n.pgNum = d.getNextPage()
 	}
 
-	p.data = n.serialize(p.data)
-
-	err := d.writePage(p)
+	err := d.writePage(d.serializeNode(n))
 	if err != nil {
 		return nil, err
 	}
@@ -196,39 +704,74 @@ func (d *dal) writeNode(n *Node) (*Node, error) {
 	return n, nil
 }
 
+// serializeNode serializes a node into its page
+func (d *dal) serializeNode(n *Node) *page {
+	p := d.allocateEmptyPage()
+	p.num = n.pgNum
+	n.serialize(p.body())
+	p.seal(pageTypeNode)
+	return p
+}
+
 func (d *dal) deleteNode(pgNum pageNum) {
 	d.releasePage(pgNum)
 }
 
+// readFreelist reads the chain of pages the freelist is stored in, starting at the freelist page of the meta.
 func (d *dal) readFreelist() (*freelist, error) {
-	p, err := d.readPage(d.freelistPage)
-	if err != nil {
-		return nil, err
+	freelist := newFreelist()
+	for pgNum := d.freelistPage; pgNum != 0; {
+		p, err := d.readPage(pgNum)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.verify(pageTypeFreelist)
+		if err != nil {
+			return nil, err
+		}
+
+		freelist.pages = append(freelist.pages, pgNum)
+		pgNum = freelist.deserialize(p.body(), len(freelist.pages) == 1)
 	}
 
-	freelist := newFreelist()
-	freelist.deserialize(p.data)
+	// Files written before the released pages were kept sorted may have them in any order
+	freelist.sortReleasedPages()
 	return freelist, nil
 }
 
-func (d *dal) writeFreelist() (*page, error) {
-	p := d.allocateEmptyPage()
-	p.num = d.freelistPage
-	d.freelist.serialize(p.data)
+func (d *dal) writeFreelist(pgNums []pageNum, freelist *freelist) error {
+	for _, p := range d.serializeFreelist(pgNums, freelist) {
+		err := d.writePage(p)
+		if err != nil {
+			return err
+		}
+	}
 
-	err := d.writePage(p)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// serializeFreelist serializes the freelist into the given chain of pages
+func (d *dal) serializeFreelist(pgNums []pageNum, freelist *freelist) []*page {
+	pages := make([]*page, len(pgNums))
+	bodies := make([]*page, len(pgNums))
+	for i, pgNum := range pgNums {
+		pages[i] = d.allocateEmptyPage()
+		pages[i].num = pgNum
+		bodies[i] = &page{num: pgNum, data: pages[i].body()}
 	}
 
-	d.freelistPage = p.num
-	return p, nil
+	freelist.serialize(bodies)
+	for _, p := range pages {
+		p.seal(pageTypeFreelist)
+	}
+	return pages
 }
 
+// writeMeta writes the meta into its meta page. The meta pages alternate between transactions, so the meta page of the
+// previous transaction stays intact.
 func (d *dal) writeMeta(meta *meta) (*page, error) {
-	p := d.allocateEmptyPage()
-	p.num = metaPageNum
-	meta.serialize(p.data)
+	p := d.serializeMeta(meta)
 
 	err := d.writePage(p)
 	if err != nil {
@@ -238,13 +781,59 @@ func (d *dal) writeMeta(meta *meta) (*page, error) {
 	return p, nil
 }
 
+// serializeMeta serializes the meta into its meta page
+func (d *dal) serializeMeta(meta *meta) *page {
+	p := d.allocateEmptyPage()
+	p.num = meta.pageNum()
+	meta.serialize(p.body())
+	p.seal(pageTypeMeta)
+	return p
+}
+
+// readMeta reads both meta pages and returns the one of the latest transaction. Meta pages that fail verification or
+// have a wrong magic number, like a meta page that was torn during a crash, are skipped. ErrInvalidDatabase is returned
+// if neither meta page has the magic number, since the file isn't a database then, unless the file has the legacy
+// layout, in which case an error wrapping ErrIncompatibleVersion is returned. An ErrCorruptPage is returned if neither
+// meta page is valid.
 func (d *dal) readMeta() (*meta, error) {
-	p, err := d.readPage(metaPageNum)
-	if err != nil {
-		return nil, err
+	var latest *meta
+	found, legacy := false, false
+	for i := 0; i < metaPagesCount; i++ {
+		p, err := d.readPage(pageNum(i))
+		if errors.Is(err, io.EOF) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			legacy = isLegacyMeta(p.data)
+		}
+
+		meta := newEmptyMeta()
+		if meta.deserialize(p.body()) != nil {
+			continue
+		}
+		found = true
+
+		if p.verify(pageTypeMeta) != nil {
+			continue
+		}
+		if latest == nil || meta.txid > latest.txid {
+			latest = meta
+		}
+	}
+
+	if !found && legacy {
+		return nil, fmt.Errorf("%w: the database was written before pages had headers, and can't be upgraded",
+			ErrIncompatibleVersion)
+	}
+	if !found {
+		return nil, ErrInvalidDatabase
+	}
+	if latest == nil {
+		return nil, &ErrCorruptPage{PageNum: 0, Reason: "neither meta page is valid"}
 	}
 
-	meta := newEmptyMeta()
-	meta.deserialize(p.data)
-	return meta, nil
+	return latest, nil
 }
@@ -1,4 +1,4 @@
-package main
+package gonosql
 
 import (
 	"os"
@@ -11,7 +11,7 @@ import (
 func createTestDAL(t *testing.T) (*dal, func()) {
 	fileName := getTempFileName()
 	dal, err := newDal(fileName, &Options{
-		pageSize: testPageSize,
+		PageSize: testPageSize,
 	})
 	require.NoError(t, err)
 
@@ -87,8 +87,8 @@ func TestCreateDalWithNewFile(t *testing.T) {
 	metaPage, err := dal.readMeta()
 	require.NoError(t, err)
 
-	freelistPageNum := pageNum(1)
-	rootPageNum := pageNum(2)
+	freelistPageNum := pageNum(2)
+	rootPageNum := pageNum(3)
 	assert.Equal(t, freelistPageNum, metaPage.freelistPage)
 	assert.Equal(t, rootPageNum, metaPage.root)
 
@@ -107,8 +107,8 @@ func TestCreateDalWithExistingFile(t *testing.T) {
 	metaPage, err := dal.readMeta()
 	require.NoError(t, err)
 
-	freelistPageNum := pageNum(1)
-	rootPageNum := pageNum(2)
+	freelistPageNum := pageNum(2)
+	rootPageNum := pageNum(3)
 	assert.Equal(t, freelistPageNum, metaPage.freelistPage)
 	assert.Equal(t, rootPageNum, metaPage.root)
 
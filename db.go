@@ -1,25 +1,42 @@
-package main
+package gonosql
 
 import (
-	"os"
+	"math"
 	"sync"
 )
 
+// noReaders is the oldest snapshot read when no read transaction is open.
+const noReaders = math.MaxUint64
+
 type DB struct {
-	rwLock sync.RWMutex // Allows only one writer at a time
+	// writeLock allows only one writer at a time. Readers don't take it, so they run alongside the writer.
+	writeLock sync.Mutex
+
+	// metaLock protects the meta of the latest commit, which read transactions start from, and readers.
+	metaLock sync.Mutex
+
+	// readers counts the open read transactions by the txid of the snapshot they read. Pages freed by commits newer
+	// than the oldest snapshot aren't reused while it's read.
+	readers map[uint64]int
+
+	// leakDetector reports the transactions left open for too long, only in debug mode
+	leakDetector *txLeakDetector
+
 	*dal
 }
 
 func Open(path string, options *Options) (*DB, error) {
-	options.pageSize = os.Getpagesize()
 	dal, err := newDal(path, options)
 	if err != nil {
 		return nil, err
 	}
 
 	db := &DB{
-		sync.RWMutex{},
-		dal,
+		readers: map[uint64]int{},
+		dal:     dal,
+	}
+	if options.DebugTx {
+		db.leakDetector = newTxLeakDetector(options.TxLeakThreshold, options.OnTxLeak)
 	}
 
 	return db, nil
@@ -29,12 +46,102 @@ func (db *DB) Close() error {
 	return db.close()
 }
 
-func (db *DB) ReadTx() *tx {
-	db.rwLock.RLock()
-	return newTx(db, false)
+// ReadTx starts a read-only transaction. It reads a snapshot of the database as of the latest commit, and doesn't
+// wait for the write transaction, nor does it see the commits made after it started.
+func (db *DB) ReadTx() *Tx {
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	tx := newTx(db, false)
+	db.readers[tx.meta.txid]++
+	db.leakDetector.track(tx)
+	return tx
 }
 
-func (db *DB) WriteTx() *tx {
-	db.rwLock.Lock()
-	return newTx(db, true)
+// closeReadTx unregisters a finished read transaction, so the pages its snapshot held can be reused.
+func (db *DB) closeReadTx(tx *Tx) {
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	db.readers[tx.meta.txid]--
+	if db.readers[tx.meta.txid] == 0 {
+		delete(db.readers, tx.meta.txid)
+	}
+}
+
+// oldestReader returns the txid of the oldest snapshot read by an open read transaction, or noReaders if there's none.
+func (db *DB) oldestReader() uint64 {
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	oldest := uint64(noReaders)
+	for txid := range db.readers {
+		oldest = min(oldest, txid)
+	}
+	return oldest
+}
+
+// publishMeta makes the meta of a commit the one new transactions start from.
+func (db *DB) publishMeta(meta *meta) {
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	db.meta = meta
+}
+
+// WriteTx starts a read-write transaction. Only one write transaction runs at a time. On a database opened in
+// read-only mode, the transaction can only read, and its write operations return ErrDatabaseReadOnly.
+func (db *DB) WriteTx() *Tx {
+	if db.readOnly {
+		return db.ReadTx()
+	}
+
+	db.writeLock.Lock()
+	db.releasePendingPages(db.oldestReader())
+	tx := newTx(db, true)
+	db.leakDetector.track(tx)
+	return tx
+}
+
+// Update runs fn inside a read-write transaction. The transaction is committed if fn returns nil, and rolled back if
+// it returns an error, which is then returned. If fn panics, the transaction is rolled back before the panic goes on.
+// fn mustn't commit or roll back the transaction itself.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return db.managed(db.WriteTx(), fn)
+}
+
+// View runs fn inside a read-only transaction, which is finished once fn returns or panics. Write operations inside
+// fn return ErrWriteInsideReadTx. The error returned by fn is returned.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	return db.managed(db.ReadTx(), fn)
+}
+
+// managed runs fn inside the given transaction and finishes it according to the outcome of fn. If fn doesn't return,
+// because it panics or calls runtime.Goexit, the transaction is rolled back and the panic goes on.
+func (db *DB) managed(tx *Tx, fn func(tx *Tx) error) error {
+	tx.managed = true
+	defer func() {
+		if tx.managed {
+			tx.managed = false
+			_ = tx.Rollback()
+		}
+	}()
+
+	err := fn(tx)
+	tx.managed = false
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Checkpoint copies the pages in the write-ahead log into the database file and truncates the log. It does nothing if
+// the database isn't opened in WAL mode.
+func (db *DB) Checkpoint() error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	return db.checkpoint()
 }
@@ -1,6 +1,12 @@
-package main
+package gonosql
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -32,7 +38,6 @@ func TestDB_CreateCollectionPutItem(t *testing.T) {
 }
 
 func TestDB_WritersDontBlockReaders(t *testing.T) {
-	t.Skip()
 	db, err := Open(getTempFileName(), &Options{MinFillPercent: 0.5, MaxFillPercent: 1.0})
 	require.NoError(t, err)
 
@@ -71,7 +76,6 @@ func TestDB_WritersDontBlockReaders(t *testing.T) {
 }
 
 func TestDB_ReadersDontSeeUncommittedChanges(t *testing.T) {
-	t.Skip()
 	db, err := Open(getTempFileName(), &Options{MinFillPercent: 0.5, MaxFillPercent: 1.0})
 	require.NoError(t, err)
 
@@ -140,3 +144,347 @@ func TestDB_DeleteItem(t *testing.T) {
 	err = tx.Commit()
 	require.NoError(t, err)
 }
+
+func TestDB_UpdateCommits(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	err := db.Update(func(tx *Tx) error {
+		collection, err := tx.CreateCollection(testCollectionName)
+		if err != nil {
+			return err
+		}
+		return collection.Put([]byte("key"), []byte("value"))
+	})
+	require.NoError(t, err)
+	require.True(t, db.writeLock.TryLock())
+	db.writeLock.Unlock()
+
+	err = db.View(func(tx *Tx) error {
+		collection, err := tx.GetCollection(testCollectionName)
+		require.NoError(t, err)
+		require.NotNil(t, collection)
+
+		item, err := collection.Find([]byte("key"))
+		require.NoError(t, err)
+		require.NotNil(t, item)
+		assert.Equal(t, []byte("value"), item.Value())
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, db.writeLock.TryLock())
+	db.writeLock.Unlock()
+}
+
+func TestDB_UpdateRollsBackOnError(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	releasedPages, maxPage := slices.Clone(db.releasedPages), db.maxPage
+	expectedErr := errors.New("update failed")
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateCollection(testCollectionName)
+		require.NoError(t, err)
+		return expectedErr
+	})
+	assert.ErrorIs(t, err, expectedErr)
+	assertPagesReleased(t, db, releasedPages, maxPage)
+
+	err = db.View(func(tx *Tx) error {
+		collection, err := tx.GetCollection(testCollectionName)
+		require.NoError(t, err)
+		assert.Nil(t, collection)
+		return expectedErr
+	})
+	assert.ErrorIs(t, err, expectedErr)
+	require.True(t, db.writeLock.TryLock())
+	db.writeLock.Unlock()
+}
+
+func TestDB_UpdateRollsBackOnPanic(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	releasedPages, maxPage := slices.Clone(db.releasedPages), db.maxPage
+	assert.PanicsWithValue(t, "update panicked", func() {
+		_ = db.Update(func(tx *Tx) error {
+			_, err := tx.CreateCollection(testCollectionName)
+			require.NoError(t, err)
+			panic("update panicked")
+		})
+	})
+	assertPagesReleased(t, db, releasedPages, maxPage)
+
+	assert.PanicsWithValue(t, "view panicked", func() {
+		_ = db.View(func(tx *Tx) error {
+			panic("view panicked")
+		})
+	})
+	require.True(t, db.writeLock.TryLock())
+	db.writeLock.Unlock()
+}
+
+func TestDB_UpdateRollsBackOnGoexit(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	releasedPages, maxPage := slices.Clone(db.releasedPages), db.maxPage
+	for _, managed := range []func(fn func(tx *Tx) error) error{db.Update, db.View} {
+		// t.FailNow, and so require, calls runtime.Goexit
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = managed(func(tx *Tx) error {
+				if tx.write {
+					_, err := tx.CreateCollection(testCollectionName)
+					require.NoError(t, err)
+				}
+				runtime.Goexit()
+				return nil
+			})
+		}()
+		<-done
+	}
+
+	assertPagesReleased(t, db, releasedPages, maxPage)
+	require.True(t, db.writeLock.TryLock())
+	db.writeLock.Unlock()
+	assert.Empty(t, db.readers)
+}
+
+func TestDB_ManagedTxCantBeFinished(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateCollection(testCollectionName)
+		require.NoError(t, err)
+
+		tx.Rollback()
+		return tx.Commit()
+	})
+	assert.ErrorIs(t, err, ErrTxManaged)
+
+	// Write operations are blocked inside View
+	err = db.View(func(tx *Tx) error {
+		_, err := tx.CreateCollection(testCollectionName)
+		return err
+	})
+	assert.ErrorIs(t, err, ErrWriteInsideReadTx)
+	require.True(t, db.writeLock.TryLock())
+	db.writeLock.Unlock()
+}
+
+func TestDB_ReadersKeepTheirSnapshot(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	keys := make([]string, mockNumberOfElements)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	putTestItems(t, db, keys...)
+
+	readTx := db.ReadTx()
+	collection, err := readTx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	// The writer overwrites and removes every item in several commits, which frees all the pages the reader reads
+	for i := 0; i < 3; i++ {
+		err = db.Update(func(tx *Tx) error {
+			collection, err := tx.GetCollection(testCollectionName)
+			require.NoError(t, err)
+			for _, key := range keys {
+				require.NoError(t, collection.Put(createItem(key), []byte("new value")))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		return tx.DeleteCollection(testCollectionName)
+	})
+	require.NoError(t, err)
+
+	// The freed pages aren't reused while the reader is open
+	require.NotEmpty(t, db.pendingPages)
+	for _, key := range keys {
+		item, err := collection.Find(createItem(key))
+		require.NoError(t, err)
+		require.NotNil(t, item, key)
+		assert.Equal(t, createItem(key), item.Value())
+	}
+	require.NoError(t, readTx.Commit())
+
+	tx := db.WriteTx()
+	assert.Empty(t, db.pendingPages)
+	tx.Rollback()
+}
+
+func TestDB_ConcurrentReadersAndWriter(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	testConcurrentReadersAndWriter(t, db)
+}
+
+// testConcurrentReadersAndWriter runs read transactions in a loop while a writer commits, and checks every reader sees
+// the state of a single commit.
+func testConcurrentReadersAndWriter(t *testing.T, db *DB) {
+	const commits = 50
+	putTestItems(t, db, "0")
+
+	// Every commit writes its number to all the keys, so a reader sees the same number in all of them
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= commits; i++ {
+			err := db.Update(func(tx *Tx) error {
+				collection, err := tx.GetCollection(testCollectionName)
+				if err != nil {
+					return err
+				}
+				for _, key := range keys {
+					err = collection.Put(createItem(key), []byte(strconv.Itoa(i)))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+		}
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		err := db.View(func(tx *Tx) error {
+			collection, err := tx.GetCollection(testCollectionName)
+			require.NoError(t, err)
+
+			var values []string
+			for _, key := range keys {
+				item, err := collection.Find(createItem(key))
+				require.NoError(t, err)
+				if item != nil {
+					values = append(values, string(item.Value()))
+				}
+			}
+			if len(values) > 0 {
+				require.Len(t, values, len(keys))
+				for _, value := range values {
+					require.Equal(t, values[0], value)
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestDB_OpenInvalidFile(t *testing.T) {
+	for name, content := range map[string][]byte{
+		"short": []byte("not a database"),
+		"pages": memset([]byte("not a database"), 4*testPageSize),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := getTempFileName()
+			require.NoError(t, os.WriteFile(path, content, 0666))
+
+			assert.NotPanics(t, func() {
+				_, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+				assert.ErrorIs(t, err, ErrInvalidDatabase)
+			})
+		})
+	}
+}
+
+func TestDB_PageSize(t *testing.T) {
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	for _, size := range []int{minPageSize, 16 * 1024, maxPageSize} {
+		for _, wal := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d/wal=%t", size, wal), func(t *testing.T) {
+				path := getTempFileName()
+				options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, PageSize: size, WAL: wal}
+				db, err := Open(path, options)
+				require.NoError(t, err)
+				assert.Equal(t, size, db.pageSize)
+				err = db.Update(func(tx *Tx) error {
+					collection, err := tx.CreateCollection(testCollectionName)
+					require.NoError(t, err)
+					for _, key := range keys {
+						require.NoError(t, collection.Put([]byte(key), createItem(key)))
+					}
+					return nil
+				})
+				require.NoError(t, err)
+				require.NoError(t, db.Close())
+
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				assert.Zero(t, info.Size()%int64(size))
+
+				// The stored page size is used, whatever the options say
+				for _, otherSize := range []int{0, 4 * 1024} {
+					db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, PageSize: otherSize, WAL: wal})
+					require.NoError(t, err)
+					assert.Equal(t, size, db.pageSize)
+					err = db.View(func(tx *Tx) error {
+						collection, err := tx.GetCollection(testCollectionName)
+						require.NoError(t, err)
+						for _, key := range keys {
+							item, err := collection.Find([]byte(key))
+							require.NoError(t, err)
+							require.NotNil(t, item, key)
+							assert.Equal(t, createItem(key), item.Value())
+						}
+						return nil
+					})
+					require.NoError(t, err)
+					require.NoError(t, db.Close())
+				}
+			})
+		}
+	}
+}
+
+func TestDB_PageSizeTornMetaPage(t *testing.T) {
+	const size = 16 * 1024
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, PageSize: size}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+	putTestItems(t, db, "0")
+	putTestItems(t, db, "1")
+	require.NoError(t, db.Close())
+
+	// Page 0 is corrupt, so the page size is read from page 1
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("torn"), pageHeaderSize)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, size, db.pageSize)
+	assertTestItems(t, db, true, "0")
+}
+
+func TestDB_InvalidPageSize(t *testing.T) {
+	for _, size := range []int{-4096, 256, 1000, 3 * 1024, 128 * 1024} {
+		_, err := Open(getTempFileName(), &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, PageSize: size})
+		assert.ErrorIs(t, err, ErrInvalidPageSize, size)
+	}
+}
@@ -0,0 +1,64 @@
+package gonosql
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+const defaultTxLeakThreshold = 10 * time.Second
+
+// TxLeak describes a transaction left open longer than Options.TxLeakThreshold in debug mode.
+type TxLeak struct {
+	Write   bool
+	Started time.Time
+
+	// Stack is the stack of the goroutine that started the transaction.
+	Stack []byte
+}
+
+// txLeakDetector reports the transactions left open longer than a threshold. A nil detector tracks nothing, so it's
+// used as is when debug mode is off.
+type txLeakDetector struct {
+	threshold time.Duration
+	report    func(leak *TxLeak)
+}
+
+func newTxLeakDetector(threshold time.Duration, report func(leak *TxLeak)) *txLeakDetector {
+	if threshold <= 0 {
+		threshold = defaultTxLeakThreshold
+	}
+	if report == nil {
+		report = logTxLeak
+	}
+
+	return &txLeakDetector{
+		threshold: threshold,
+		report:    report,
+	}
+}
+
+// track records the stack of a transaction that just started, and reports it unless it's closed within the threshold.
+func (d *txLeakDetector) track(tx *Tx) {
+	if d == nil {
+		return
+	}
+
+	leak := &TxLeak{
+		Write:   tx.write,
+		Started: time.Now(),
+		Stack:   debug.Stack(),
+	}
+	tx.leakTimer = time.AfterFunc(d.threshold, func() {
+		d.report(leak)
+	})
+}
+
+func logTxLeak(leak *TxLeak) {
+	kind := "read"
+	if leak.Write {
+		kind = "write"
+	}
+
+	log.Printf("gonosql: %s transaction open for %s, started at:\n%s", kind, time.Since(leak.Started), leak.Stack)
+}
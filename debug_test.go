@@ -0,0 +1,44 @@
+package gonosql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugTx_ReportsLeakedTx(t *testing.T) {
+	leaks := make(chan *TxLeak, 2)
+	db, err := Open(getTempFileName(), &Options{
+		MinFillPercent:  testMinPercentage,
+		MaxFillPercent:  testMaxPercentage,
+		DebugTx:         true,
+		TxLeakThreshold: 20 * time.Millisecond,
+		OnTxLeak: func(leak *TxLeak) {
+			leaks <- leak
+		},
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	// A transaction closed in time isn't reported
+	require.NoError(t, db.ReadTx().Commit())
+
+	tx := db.WriteTx()
+	select {
+	case leak := <-leaks:
+		assert.True(t, leak.Write)
+		assert.Contains(t, string(leak.Stack), "TestDebugTx_ReportsLeakedTx")
+		assert.GreaterOrEqual(t, time.Since(leak.Started), 20*time.Millisecond)
+	case <-time.After(time.Second):
+		require.Fail(t, "the leaked transaction wasn't reported")
+	}
+	require.NoError(t, tx.Rollback())
+
+	select {
+	case leak := <-leaks:
+		require.Fail(t, "a transaction closed in time was reported", string(leak.Stack))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
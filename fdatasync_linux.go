@@ -0,0 +1,12 @@
+package gonosql
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdatasync flushes the data of the file to the disk, skipping metadata like the modification time that isn't needed
+// to read the data back.
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
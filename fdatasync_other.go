@@ -0,0 +1,10 @@
+//go:build !linux
+
+package gonosql
+
+import "os"
+
+// fdatasync flushes the file to the disk. Platforms without fdatasync fall back to a full sync.
+func fdatasync(file *os.File) error {
+	return file.Sync()
+}
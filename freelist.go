@@ -1,18 +1,26 @@
-package main
+package gonosql
 
-import "encoding/binary"
+import (
+	"cmp"
+	"encoding/binary"
+	"slices"
+)
 
-// metaPage is the maximum pageNum that is used by the db for its own purposes. For now, only page 0 is used as the
-// header page. It means all other page numbers can be used.
-const metaPage = 0
+// metaPage is the maximum pageNum that is used by the db for its own purposes. For now, pages 0 and 1 are used as the
+// meta pages. It means all other page numbers can be used.
+const metaPage = metaPagesCount - 1
 
 // freelist manages the manages free and used pages.
 type freelist struct {
 	// maxPage holds the latest page num allocated. releasedPages holds all the ids that were released during
 	// delete. New page ids are first given from the releasedPageIDs to avoid growing the file. If it's empty, then
-	// maxPage is incremented and a new page is created thus increasing the file size.
+	// maxPage is incremented and a new page is created thus increasing the file size. releasedPages is kept sorted in
+	// descending order, so the lowest pages are given first and runs of consecutive pages are found in a single pass.
 	maxPage       pageNum
 	releasedPages []pageNum
+
+	// pages holds the chain of pages the freelist is stored in
+	pages []pageNum
 }
 
 func newFreelist() *freelist {
@@ -36,39 +44,169 @@ func (fr *freelist) getNextPage() pageNum {
 	return fr.maxPage
 }
 
+// getNextPages returns the first of n consecutive pages for writing. The lowest run of released pages is used if
+// there's one, otherwise the file is grown by n pages.
+func (fr *freelist) getNextPages(n int) pageNum {
+	if n == 1 {
+		return fr.getNextPage()
+	}
+
+	// The released pages are sorted in descending order, so runs are searched from the end of the list
+	runEnd := len(fr.releasedPages) - 1
+	for i := len(fr.releasedPages) - 1; i >= 0; i-- {
+		if i < len(fr.releasedPages)-1 && fr.releasedPages[i] != fr.releasedPages[i+1]+1 {
+			runEnd = i
+		}
+
+		if runEnd-i+1 == n {
+			pageID := fr.releasedPages[runEnd]
+			fr.releasedPages = slices.Delete(fr.releasedPages, i, runEnd+1)
+			return pageID
+		}
+	}
+
+	pageID := fr.maxPage + 1
+	fr.maxPage += pageNum(n)
+	return pageID
+}
+
+// releasePage inserts a page into the released pages, where it belongs in their descending order.
 func (fr *freelist) releasePage(page pageNum) {
-	fr.releasedPages = append(fr.releasedPages, page)
+	i, _ := slices.BinarySearchFunc(fr.releasedPages, page, descending)
+	fr.releasedPages = slices.Insert(fr.releasedPages, i, page)
 }
 
-func (fr *freelist) serialize(buf []byte) []byte {
-	pos := 0
+// withReleasedPages returns a copy of the freelist in which the given pages are released as well. The pages are merged
+// into the released pages, which stay in descending order.
+func (fr *freelist) withReleasedPages(pages []pageNum) *freelist {
+	pages = slices.Clone(pages)
+	slices.SortFunc(pages, descending)
+	releasedPages := make([]pageNum, 0, len(fr.releasedPages)+len(pages))
+	i, j := 0, 0
+	for i < len(fr.releasedPages) && j < len(pages) {
+		if fr.releasedPages[i] > pages[j] {
+			releasedPages = append(releasedPages, fr.releasedPages[i])
+			i++
+		} else {
+			releasedPages = append(releasedPages, pages[j])
+			j++
+		}
+	}
+	releasedPages = append(releasedPages, fr.releasedPages[i:]...)
+	releasedPages = append(releasedPages, pages[j:]...)
 
-	binary.LittleEndian.PutUint16(buf[pos:], uint16(fr.maxPage))
-	pos += 2
+	return &freelist{
+		maxPage:       fr.maxPage,
+		releasedPages: releasedPages,
+	}
+}
 
-	// released pages count
-	binary.LittleEndian.PutUint16(buf[pos:], uint16(len(fr.releasedPages)))
-	pos += 2
+// pagesCount returns the number of pages needed to store the freelist.
+func (fr *freelist) pagesCount(pageSize int) int {
+	capacity := (pageSize - freelistPageHeaderSize) / pageNumSize
 
-	for _, page := range fr.releasedPages {
-		binary.LittleEndian.PutUint64(buf[pos:], uint64(page))
-		pos += pageNumSize
+	// The first page holds the max page as well, which takes the place of one released page
+	firstCapacity := capacity - 1
+	if len(fr.releasedPages) <= firstCapacity {
+		return 1
 	}
 
-	return buf
+	return 1 + (len(fr.releasedPages)-firstCapacity+capacity-1)/capacity
+}
+
+// serialize writes the freelist into the given chain of pages, which must be at least pagesCount long. Every page
+// holds the number of the next page in the chain (0 for the last one), the number of released pages it holds, and
+// the released pages themselves. The first page starts with the max page.
+// ---------------------------------------------------------------------------------
+// | max page (first page only) | next page | count | released page | released page |
+// ---------------------------------------------------------------------------------
+func (fr *freelist) serialize(pages []*page) {
+	releasedPages := fr.releasedPages
+	for i, p := range pages {
+		pos := 0
+		if i == 0 {
+			binary.LittleEndian.PutUint64(p.data[pos:], uint64(fr.maxPage))
+			pos += pageNumSize
+		}
+
+		var next pageNum
+		if i < len(pages)-1 {
+			next = pages[i+1].num
+		}
+		binary.LittleEndian.PutUint64(p.data[pos:], uint64(next))
+		pos += pageNumSize
+
+		count := min(len(releasedPages), (len(p.data)-pos-releasedCountSize)/pageNumSize)
+		binary.LittleEndian.PutUint64(p.data[pos:], uint64(count))
+		pos += releasedCountSize
+
+		for _, page := range releasedPages[:count] {
+			binary.LittleEndian.PutUint64(p.data[pos:], uint64(page))
+			pos += pageNumSize
+		}
+		releasedPages = releasedPages[count:]
+	}
 }
 
-func (fr *freelist) deserialize(buf []byte) {
+// deserialize reads a page of the freelist chain and returns the number of the next page in the chain, 0 if it's the
+// last one.
+func (fr *freelist) deserialize(buf []byte, first bool) pageNum {
 	pos := 0
-	fr.maxPage = pageNum(binary.LittleEndian.Uint16(buf[pos:]))
-	pos += 2
+	if first {
+		fr.maxPage = pageNum(binary.LittleEndian.Uint64(buf[pos:]))
+		pos += pageNumSize
+	}
+
+	next := pageNum(binary.LittleEndian.Uint64(buf[pos:]))
+	pos += pageNumSize
 
-	// released pages count
-	releasedPagesCount := int(binary.LittleEndian.Uint16(buf[pos:]))
-	pos += 2
+	releasedPagesCount := int(binary.LittleEndian.Uint64(buf[pos:]))
+	pos += releasedCountSize
 
 	for i := 0; i < releasedPagesCount; i++ {
 		fr.releasedPages = append(fr.releasedPages, pageNum(binary.LittleEndian.Uint64(buf[pos:])))
 		pos += pageNumSize
 	}
+
+	return next
+}
+
+// highestUsedPage returns the highest page that isn't free. Pages past it can be cut off the file.
+func (fr *freelist) highestUsedPage() pageNum {
+	released := make(map[pageNum]struct{}, len(fr.releasedPages))
+	for _, pgNum := range fr.releasedPages {
+		released[pgNum] = struct{}{}
+	}
+
+	pgNum := fr.maxPage
+	for ; pgNum > metaPage; pgNum-- {
+		if _, ok := released[pgNum]; !ok {
+			break
+		}
+	}
+	return pgNum
+}
+
+// packedMaxPage returns the max page the database would have if it had no free pages.
+func (fr *freelist) packedMaxPage() pageNum {
+	return fr.maxPage - pageNum(len(fr.releasedPages))
+}
+
+// sortReleasedPages sorts the released pages in descending order. It's needed only after the released pages are read,
+// since the other changes keep them sorted.
+func (fr *freelist) sortReleasedPages() {
+	slices.SortFunc(fr.releasedPages, descending)
+}
+
+// descending compares page numbers so they are sorted in descending order.
+func descending(a, b pageNum) int {
+	return cmp.Compare(b, a)
+}
+
+// truncate drops the pages past the given page, which must all be released, from the freelist.
+func (fr *freelist) truncate(maxPage pageNum) {
+	fr.releasedPages = slices.DeleteFunc(fr.releasedPages, func(pgNum pageNum) bool {
+		return pgNum > maxPage
+	})
+	fr.maxPage = maxPage
 }
@@ -1,4 +1,4 @@
-package main
+package gonosql
 
 import (
 	"os"
@@ -8,22 +8,31 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func createTestFreelistPages(pgNums ...pageNum) []*page {
+	pages := make([]*page, len(pgNums))
+	for i, pgNum := range pgNums {
+		pages[i] = &page{num: pgNum, data: make([]byte, testPageSize, testPageSize)}
+	}
+	return pages
+}
+
 func TestFreelistSerialize(t *testing.T) {
 	freelist := newFreelist()
 	freelist.maxPage = 5
 	freelist.releasedPages = []pageNum{1, 2, 3}
-	actual := freelist.serialize(make([]byte, testPageSize, testPageSize))
+	pages := createTestFreelistPages(4)
+	freelist.serialize(pages)
 
 	expected, err := os.ReadFile(getExpectedResultFileName(t.Name()))
 	require.NoError(t, err)
 
-	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected, pages[0].data)
 }
 
 func TestFreelistDeserialize(t *testing.T) {
 	freelist, err := os.ReadFile(getExpectedResultFileName(t.Name()))
 	actual := newFreelist()
-	actual.deserialize(freelist)
+	next := actual.deserialize(freelist, true)
 	require.NoError(t, err)
 
 	expected := newFreelist()
@@ -31,4 +40,141 @@ func TestFreelistDeserialize(t *testing.T) {
 	expected.releasedPages = []pageNum{1, 2, 3}
 
 	assert.Equal(t, expected, actual)
+	assert.Equal(t, pageNum(0), next)
+}
+
+func TestFreelistSerializeChain(t *testing.T) {
+	freelist := newFreelist()
+	freelist.maxPage = 1 << 40
+	for i := 0; i < 2000; i++ {
+		freelist.releasedPages = append(freelist.releasedPages, pageNum(1<<33+i))
+	}
+
+	pagesCount := freelist.pagesCount(testPageSize)
+	require.Equal(t, 4, pagesCount)
+	pages := createTestFreelistPages(10, 20, 30, 40)
+	freelist.serialize(pages)
+
+	actual := newFreelist()
+	next := pages[0].num
+	for i := 0; next != 0; i++ {
+		require.Equal(t, pages[i].num, next)
+		next = actual.deserialize(pages[i].data, i == 0)
+	}
+
+	assert.Equal(t, freelist.maxPage, actual.maxPage)
+	assert.Equal(t, freelist.releasedPages, actual.releasedPages)
+}
+
+func TestFreelistPagesCount(t *testing.T) {
+	freelist := newFreelist()
+	capacity := (testPageSize - freelistPageHeaderSize) / pageNumSize
+
+	freelist.releasedPages = make([]pageNum, capacity-1)
+	assert.Equal(t, 1, freelist.pagesCount(testPageSize))
+
+	freelist.releasedPages = make([]pageNum, capacity)
+	assert.Equal(t, 2, freelist.pagesCount(testPageSize))
+
+	freelist.releasedPages = make([]pageNum, 2*capacity-1)
+	assert.Equal(t, 2, freelist.pagesCount(testPageSize))
+
+	freelist.releasedPages = make([]pageNum, 2*capacity)
+	assert.Equal(t, 3, freelist.pagesCount(testPageSize))
+}
+
+func TestFreelistGetNextPages(t *testing.T) {
+	freelist := newFreelist()
+	freelist.maxPage = 20
+	freelist.releasedPages = []pageNum{12, 11, 10, 9, 6, 5, 3}
+
+	assert.Equal(t, pageNum(9), freelist.getNextPages(3))
+	assert.Equal(t, []pageNum{12, 6, 5, 3}, freelist.releasedPages)
+
+	assert.Equal(t, pageNum(5), freelist.getNextPages(2))
+	assert.Equal(t, []pageNum{12, 3}, freelist.releasedPages)
+
+	// No run is long enough, so the file grows
+	assert.Equal(t, pageNum(21), freelist.getNextPages(2))
+	assert.Equal(t, pageNum(22), freelist.maxPage)
+	assert.Equal(t, []pageNum{12, 3}, freelist.releasedPages)
+
+	// Single pages are still allocated from the lowest released pages
+	assert.Equal(t, pageNum(3), freelist.getNextPage())
+	assert.Equal(t, pageNum(12), freelist.getNextPage())
+}
+
+func TestFreelistReleasedPagesSorted(t *testing.T) {
+	freelist := newFreelist()
+	for _, pgNum := range []pageNum{7, 3, 12, 5, 9} {
+		freelist.releasePage(pgNum)
+	}
+	assert.Equal(t, []pageNum{12, 9, 7, 5, 3}, freelist.releasedPages)
+
+	released := freelist.withReleasedPages([]pageNum{4, 13, 8, 2})
+	assert.Equal(t, []pageNum{13, 12, 9, 8, 7, 5, 4, 3, 2}, released.releasedPages)
+	assert.Equal(t, []pageNum{12, 9, 7, 5, 3}, freelist.releasedPages)
+
+	// The released pages of a freelist read from a file are sorted as well
+	freelist.releasedPages = []pageNum{3, 9, 5, 12, 7}
+	freelist.sortReleasedPages()
+	assert.Equal(t, []pageNum{12, 9, 7, 5, 3}, freelist.releasedPages)
+}
+
+func TestFreelistChainPersisted(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+
+	// Releasing a value spanning a thousand overflow pages needs a freelist longer than a page
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+	err = collection.Put([]byte("key"), memset([]byte("v"), 1000*db.overflowPageCapacity()))
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	tx = db.WriteTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	require.NoError(t, collection.Remove([]byte("key")))
+	require.NoError(t, tx.Commit())
+
+	require.Greater(t, len(db.freelist.pages), 1)
+	expectedFreelist := *db.freelist
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, expectedFreelist.maxPage, db.maxPage)
+	assert.Equal(t, expectedFreelist.pages, db.freelist.pages)
+	assert.ElementsMatch(t, expectedFreelist.releasedPages, db.releasedPages)
+
+	// The old chain is released when the freelist is rewritten
+	oldPages := db.freelist.pages
+	putTestItems(t, db, "0")
+	assert.Subset(t, db.releasedPages, oldPages)
+}
+
+func TestFreelistCompactionHelpers(t *testing.T) {
+	freelist := newFreelist()
+	freelist.maxPage = 10
+	freelist.releasedPages = []pageNum{10, 9, 7, 5, 3}
+
+	assert.Equal(t, pageNum(8), freelist.highestUsedPage())
+	assert.Equal(t, pageNum(5), freelist.packedMaxPage())
+
+	assert.Equal(t, pageNum(3), freelist.getNextPage())
+	assert.Equal(t, pageNum(5), freelist.getNextPage())
+
+	freelist.truncate(8)
+	assert.Equal(t, pageNum(8), freelist.maxPage)
+	assert.Equal(t, []pageNum{7}, freelist.releasedPages)
+
+	// Without released pages, the max page is the highest page in use
+	freelist.releasedPages = nil
+	assert.Equal(t, pageNum(8), freelist.highestUsedPage())
 }
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package gonosql
+
+import (
+	"os"
+	"time"
+)
+
+// flock is a no-op on platforms without flock. The database file isn't protected from other processes there.
+func flock(*os.File, bool, time.Duration) error {
+	return nil
+}
+
+func funlock(*os.File) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package gonosql
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lockTestOptions(readOnly bool) *Options {
+	return &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, ReadOnly: readOnly,
+		LockTimeout: 100 * time.Millisecond}
+}
+
+func TestLock_WriterIsExclusive(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, lockTestOptions(false))
+	require.NoError(t, err)
+
+	_, err = Open(path, lockTestOptions(false))
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	_, err = Open(path, lockTestOptions(true))
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, lockTestOptions(false))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestLock_ReadersShareTheLock(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, lockTestOptions(false))
+	require.NoError(t, err)
+	putTestItems(t, db, "0")
+	require.NoError(t, db.Close())
+
+	reader1, err := Open(path, lockTestOptions(true))
+	require.NoError(t, err)
+	reader2, err := Open(path, lockTestOptions(true))
+	require.NoError(t, err)
+
+	_, err = Open(path, lockTestOptions(false))
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	assertTestItems(t, reader1, true, "0")
+	assertTestItems(t, reader2, true, "0")
+
+	require.NoError(t, reader1.Close())
+	require.NoError(t, reader2.Close())
+}
+
+func TestLock_WaitsForTheLock(t *testing.T) {
+	path := getTempFileName()
+	holder, err := Open(path, lockTestOptions(false))
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = holder.Close()
+	}()
+
+	options := lockTestOptions(false)
+	options.LockTimeout = 0
+	db, err := Open(path, options)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestLock_ReadOnly(t *testing.T) {
+	path := getTempFileName()
+
+	// A database isn't created in read-only mode
+	_, err := Open(path, lockTestOptions(true))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	db, err := Open(path, lockTestOptions(false))
+	require.NoError(t, err)
+	putTestItems(t, db, "0")
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, lockTestOptions(true))
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx := db.WriteTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	err = collection.Put(createItem("1"), createItem("1"))
+	assert.ErrorIs(t, err, ErrDatabaseReadOnly)
+	err = collection.Remove(createItem("0"))
+	assert.ErrorIs(t, err, ErrDatabaseReadOnly)
+	_, err = tx.CreateCollection([]byte("test2"))
+	assert.ErrorIs(t, err, ErrDatabaseReadOnly)
+	err = tx.DeleteCollection(testCollectionName)
+	assert.ErrorIs(t, err, ErrDatabaseReadOnly)
+	require.NoError(t, tx.Commit())
+
+	assertTestItems(t, db, true, "0")
+}
+
+func TestLock_ReadOnlyReadsThroughLeftoverLog(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, walTestOptions())
+	require.NoError(t, err)
+	putTestItems(t, db, "0", "1")
+	crashTestDB(t, db)
+
+	db, err = Open(path, lockTestOptions(true))
+	require.NoError(t, err)
+
+	assertTestItems(t, db, true, "0", "1")
+	assert.ErrorIs(t, db.Checkpoint(), ErrDatabaseReadOnly)
+	require.NoError(t, db.Close())
+
+	// The log is left for the next writer to recover
+	_, err = os.Stat(walPath(path))
+	require.NoError(t, err)
+
+	db, err = Open(path, lockTestOptions(false))
+	require.NoError(t, err)
+	defer db.Close()
+	assertTestItems(t, db, true, "0", "1")
+}
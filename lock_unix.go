@@ -0,0 +1,47 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package gonosql
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// flockRetryInterval is how long to wait between attempts to take a lock held by another process.
+const flockRetryInterval = 50 * time.Millisecond
+
+// flock takes an advisory lock on the file, exclusive for writers and shared for readers. When the timeout is zero, it
+// waits for the lock as long as it takes. Otherwise, ErrTimeout is returned once the timeout passes.
+func flock(file *os.File, exclusive bool, timeout time.Duration) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		time.Sleep(flockRetryInterval)
+	}
+}
+
+// funlock releases the lock taken by flock.
+func funlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
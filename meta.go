@@ -1,12 +1,34 @@
-package main
+package gonosql
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
 
 const (
 	magicNumber uint32 = 0xD00DB00D
-	metaPageNum        = 0
+
+	// The meta page is kept in two copies, in pages 0 and 1. Commits alternate between them, so if a commit is torn
+	// while writing one copy, the other still describes the previous consistent state of the database.
+	metaPagesCount = 2
+
+	// formatVersion is the version of the on-disk format written by this package. It's bumped on every change to the
+	// format, along with a migration upgrading databases from the previous version. See migrations.
+	formatVersion uint32 = 1
+
+	formatVersionSize = 4
+	pageSizeSize      = 4
+
+	minPageSize = 512
+	maxPageSize = 64 * 1024
 )
 
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 // meta is the meta page of the db
 type meta struct {
 	// The database has a root collection that holds all the collections in the database. It is called root and the
@@ -15,37 +37,129 @@ type meta struct {
 	// and the root page are located, a search inside a collection can be made.
 	root         pageNum
 	freelistPage pageNum
+
+	// txid is the id of the last committed transaction. It's used to pick the latest of the two meta pages.
+	txid uint64
+
+	// version is the format version of the database.
+	version uint32
+
+	// pageSize is the size of the pages of the database, in bytes.
+	pageSize uint32
 }
 
 func newEmptyMeta() *meta {
 	return &meta{}
 }
 
+// isLegacyMeta returns whether the first page of a file is the meta page of the legacy layout, from before pages had
+// headers, which starts with the magic number. Such files have a single meta page, and nodes without headers, so they
+// can't be upgraded.
+func isLegacyMeta(buf []byte) bool {
+	return len(buf) >= magicNumberSize && binary.LittleEndian.Uint32(buf) == magicNumber
+}
+
+// pageNum returns the meta page the meta is written to. Each transaction writes to a different page than the one
+// before it.
+func (m *meta) pageNum() pageNum {
+	return pageNum(m.txid % metaPagesCount)
+}
+
+// The body of the meta page structure is:
+// ------------------------------------------------------------------------------
+// | magic number | txid | root page | freelist page | version | page size | ...  |
+// ------------------------------------------------------------------------------
+// The meta page is checksummed by its page header, like every other page.
 func (m *meta) serialize(buf []byte) {
 	pos := 0
 
 	binary.LittleEndian.PutUint32(buf[pos:], magicNumber)
 	pos += magicNumberSize
 
+	binary.LittleEndian.PutUint64(buf[pos:], m.txid)
+	pos += txIDSize
+
 	binary.LittleEndian.PutUint64(buf[pos:], uint64(m.root))
 	pos += pageNumSize
 
 	binary.LittleEndian.PutUint64(buf[pos:], uint64(m.freelistPage))
 	pos += pageNumSize
+
+	binary.LittleEndian.PutUint32(buf[pos:], m.version)
+	pos += formatVersionSize
+
+	binary.LittleEndian.PutUint32(buf[pos:], m.pageSize)
+	pos += pageSizeSize
 }
 
-func (m *meta) deserialize(buf []byte) {
+// deserialize reads the meta from the body of a meta page. ErrInvalidDatabase is returned if the magic number doesn't
+// match, which means the file isn't a database.
+func (m *meta) deserialize(buf []byte) error {
 	pos := 0
 	magicNumberRes := binary.LittleEndian.Uint32(buf[pos:])
 	pos += magicNumberSize
 
 	if magicNumberRes != magicNumber {
-		panic("The file is not a libra db file")
+		return ErrInvalidDatabase
 	}
 
+	m.txid = binary.LittleEndian.Uint64(buf[pos:])
+	pos += txIDSize
+
 	m.root = pageNum(binary.LittleEndian.Uint64(buf[pos:]))
 	pos += pageNumSize
 
 	m.freelistPage = pageNum(binary.LittleEndian.Uint64(buf[pos:]))
 	pos += pageNumSize
+
+	m.version = binary.LittleEndian.Uint32(buf[pos:])
+	pos += formatVersionSize
+
+	m.pageSize = binary.LittleEndian.Uint32(buf[pos:])
+	pos += pageSizeSize
+	return nil
+}
+
+// checkVersion returns an error wrapping ErrIncompatibleVersion if the database was written by a newer version of the
+// format, which this package can't read.
+func (m *meta) checkVersion() error {
+	if m.version > formatVersion {
+		return fmt.Errorf("%w: the database has format version %d, but only versions up to %d are supported",
+			ErrIncompatibleVersion, m.version, formatVersion)
+	}
+	return nil
+}
+
+// isValidPageSize reports whether the page size is a power of two between minPageSize and maxPageSize.
+func isValidPageSize(size int) bool {
+	return size >= minPageSize && size <= maxPageSize && size&(size-1) == 0
+}
+
+// readPageSize returns the page size stored in the meta pages of a database file, so it's read with the geometry it
+// was created with whatever the page size of the system. The meta pages are looked for at every valid page size, and
+// a meta page only counts if it's valid at the page size it stores. The page size of the system is returned when no
+// meta page is found. Reading the meta then reports why the file can't be opened.
+func readPageSize(file *os.File) (int, error) {
+	for size := minPageSize; size <= maxPageSize; size *= 2 {
+		for i := 0; i < metaPagesCount; i++ {
+			p := &page{num: pageNum(i), data: make([]byte, size)}
+			_, err := file.ReadAt(p.data, int64(i)*int64(size))
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+
+			m := newEmptyMeta()
+			if m.deserialize(p.body()) != nil || p.verify(pageTypeMeta) != nil {
+				continue
+			}
+			if int(m.pageSize) == size {
+				return size, nil
+			}
+		}
+	}
+
+	return os.Getpagesize(), nil
 }
@@ -1,4 +1,4 @@
-package main
+package gonosql
 
 import (
 	"os"
@@ -12,6 +12,8 @@ func TestMetaSerialize(t *testing.T) {
 	meta := newEmptyMeta()
 	meta.root = 3
 	meta.freelistPage = 4
+	meta.version = formatVersion
+	meta.pageSize = testPageSize
 	actual := make([]byte, testPageSize, testPageSize)
 	meta.serialize(actual)
 
@@ -25,20 +27,20 @@ func TestCreateDalIncorrectMagicNumber(t *testing.T) {
 	actualMetaBytes, err := os.ReadFile(getExpectedResultFileName(t.Name()))
 	require.NoError(t, err)
 	actualMeta := newEmptyMeta()
-	assert.Panics(t, func() {
-		actualMeta.deserialize(actualMetaBytes)
-	})
+	assert.ErrorIs(t, actualMeta.deserialize(actualMetaBytes), ErrInvalidDatabase)
 }
 
 func TestMetaDeserialize(t *testing.T) {
 	actualMetaBytes, err := os.ReadFile(getExpectedResultFileName(t.Name()))
-	actualMeta := newEmptyMeta()
-	actualMeta.deserialize(actualMetaBytes)
 	require.NoError(t, err)
+	actualMeta := newEmptyMeta()
+	require.NoError(t, actualMeta.deserialize(actualMetaBytes))
 
 	expectedMeta := newEmptyMeta()
 	expectedMeta.root = 3
 	expectedMeta.freelistPage = 4
+	expectedMeta.version = formatVersion
+	expectedMeta.pageSize = testPageSize
 
 	assert.Equal(t, expectedMeta, actualMeta)
 }
@@ -0,0 +1,57 @@
+package gonosql
+
+import "fmt"
+
+// migration upgrades a database from the format version it's registered for to the next one. It works on a copy of the
+// meta of the latest commit, which is written once all the migrations ran. A migration that rewrites pages has to move
+// them to new pages, like a commit does, so a crash during the upgrade leaves the database in its previous version.
+type migration func(d *dal, m *meta) error
+
+// migrations holds the upgrade from every format version older than formatVersion, by the version it upgrades from.
+// Version 1 is the first versioned format, so there's none yet. Databases of the legacy layout, from before pages had
+// headers, can't be upgraded, see isLegacyMeta.
+var migrations = map[uint32]migration{}
+
+// upgrade runs the migrations from the version of the database up to formatVersion, and then writes the upgraded meta
+// as a new commit. An error wrapping ErrIncompatibleVersion is returned if a migration is missing, or if the database
+// is opened in read-only mode, in which case it can't be upgraded.
+func (d *dal) upgrade() error {
+	if d.version == formatVersion {
+		return nil
+	}
+	if d.readOnly {
+		return fmt.Errorf("%w: the database has format version %d and has to be opened for writing to be upgraded to version %d",
+			ErrIncompatibleVersion, d.version, formatVersion)
+	}
+
+	meta := *d.meta
+	for meta.version < formatVersion {
+		migrate, ok := migrations[meta.version]
+		if !ok {
+			return fmt.Errorf("%w: no migration from format version %d", ErrIncompatibleVersion, meta.version)
+		}
+
+		err := migrate(d, &meta)
+		if err != nil {
+			return fmt.Errorf("could not upgrade the database from format version %d: %w", meta.version, err)
+		}
+		meta.version++
+	}
+
+	// The upgraded meta is written to the other meta page, so the meta page of the previous version stays intact until
+	// the upgrade is complete.
+	meta.txid += 1
+	_, err := d.writeMeta(&meta)
+	if err != nil {
+		return err
+	}
+	if d.syncMode != SyncNone {
+		err = fdatasync(d.file)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.meta = &meta
+	return nil
+}
@@ -0,0 +1,144 @@
+package gonosql
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteTestMeta applies fn to both meta pages of a closed database.
+func rewriteTestMeta(t *testing.T, path string, fn func(m *meta)) {
+	d := &dal{pageSize: os.Getpagesize()}
+	var err error
+	d.file, err = os.OpenFile(path, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	defer d.file.Close()
+
+	for i := 0; i < metaPagesCount; i++ {
+		p, err := d.readPage(pageNum(i))
+		require.NoError(t, err)
+		if p.verify(pageTypeMeta) != nil {
+			continue
+		}
+
+		m := newEmptyMeta()
+		require.NoError(t, m.deserialize(p.body()))
+		fn(m)
+		_, err = d.writeMeta(m)
+		require.NoError(t, err)
+	}
+}
+
+func createTestVersionedDB(t *testing.T, version uint32) string {
+	path := getTempFileName()
+	db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	putTestItems(t, db, "0", "1")
+	require.NoError(t, db.Close())
+
+	rewriteTestMeta(t, path, func(m *meta) {
+		m.version = version
+	})
+	return path
+}
+
+// registerTestMigrations replaces the migrations from every version older than formatVersion with fn. It returns a
+// function restoring the registered migrations.
+func registerTestMigrations(fn migration) func() {
+	registered := migrations
+	migrations = map[uint32]migration{}
+	for version := uint32(0); version < formatVersion; version++ {
+		migrations[version] = fn
+	}
+	return func() { migrations = registered }
+}
+
+func TestMigration_Upgrade(t *testing.T) {
+	path := createTestVersionedDB(t, formatVersion-1)
+	restoreFunc := registerTestMigrations(func(d *dal, m *meta) error {
+		return nil
+	})
+	defer restoreFunc()
+
+	db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	txid := db.txid
+	assert.Equal(t, formatVersion, db.version)
+	assertTestItems(t, db, true, "0", "1")
+	require.NoError(t, db.Close())
+
+	// The upgrade is persisted
+	db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, formatVersion, db.version)
+	assert.Equal(t, txid, db.txid)
+	assertTestItems(t, db, true, "0", "1")
+}
+
+func TestMigration_UpgradeReadOnly(t *testing.T) {
+	path := createTestVersionedDB(t, formatVersion-1)
+	restoreFunc := registerTestMigrations(func(d *dal, m *meta) error {
+		return nil
+	})
+	defer restoreFunc()
+
+	_, err := Open(path, &Options{ReadOnly: true})
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+func TestMigration_MissingMigration(t *testing.T) {
+	// Version 1 is the first versioned format, so older versions have no migration
+	path := createTestVersionedDB(t, 0)
+
+	_, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+func TestMigration_RunsInOrder(t *testing.T) {
+	path := createTestVersionedDB(t, 0)
+
+	var ran []uint32
+	restoreFunc := registerTestMigrations(func(d *dal, m *meta) error {
+		ran = append(ran, m.version)
+		return nil
+	})
+	defer restoreFunc()
+
+	db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+
+	expected := make([]uint32, 0, formatVersion)
+	for version := uint32(0); version < formatVersion; version++ {
+		expected = append(expected, version)
+	}
+	assert.Equal(t, expected, ran)
+}
+
+func TestMigration_NewerVersion(t *testing.T) {
+	path := createTestVersionedDB(t, formatVersion+1)
+
+	_, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+func TestMigration_LegacyLayout(t *testing.T) {
+	// The meta page of the legacy layout holds the magic number, the root page and the freelist page, without a header
+	content := make([]byte, 4*testPageSize)
+	binary.LittleEndian.PutUint32(content, magicNumber)
+	binary.LittleEndian.PutUint64(content[magicNumberSize:], 2)
+	binary.LittleEndian.PutUint64(content[magicNumberSize+pageNumSize:], 1)
+	path := getTempFileName()
+	require.NoError(t, os.WriteFile(path, content, 0666))
+	defer os.Remove(path)
+
+	for _, readOnly := range []bool{false, true} {
+		_, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, ReadOnly: readOnly})
+		assert.ErrorIs(t, err, ErrIncompatibleVersion)
+		assert.NotErrorIs(t, err, ErrInvalidDatabase)
+	}
+}
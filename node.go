@@ -1,18 +1,29 @@
-package main
+package gonosql
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
 )
 
 type Item struct {
 	key   []byte
 	value []byte
+
+	// A value bigger than the inline threshold is stored in a chain of overflow pages and the item only keeps the first
+	// page of the chain and the size of the value. The value is read from the chain only when it's needed.
+	overflowPage pageNum
+	overflowSize int
+
+	// collection marks an item holding the record of a collection nested in the item's collection
+	collection bool
 }
 
 type Node struct {
 	// associated transaction
-	tx *tx
+	tx *Tx
 
 	pgNum      pageNum
 	items      []*Item
@@ -31,6 +42,17 @@ func NewNodeForSerialization(items []*Item, childNodes []pageNum) *Node {
 	}
 }
 
+// clone returns a copy of the node that can be modified without affecting the node. Items are never modified once
+// they're in a node, so they're shared.
+func (n *Node) clone() *Node {
+	return &Node{
+		tx:         n.tx,
+		pgNum:      n.pgNum,
+		items:      slices.Clone(n.items),
+		childNodes: slices.Clone(n.childNodes),
+	}
+}
+
 func newItem(key []byte, value []byte) *Item {
 	return &Item{
 		key:   key,
@@ -38,6 +60,57 @@ func newItem(key []byte, value []byte) *Item {
 	}
 }
 
+// Key returns the key of the item.
+func (i *Item) Key() []byte {
+	return i.key
+}
+
+// Value returns the value of the item.
+func (i *Item) Value() []byte {
+	return i.value
+}
+
+// IsCollection returns whether the item holds a nested collection rather than a value. Nested collections are opened
+// with Collection.GetCollection.
+func (i *Item) IsCollection() bool {
+	return i.collection
+}
+
+func (i *Item) isOverflow() bool {
+	return i.overflowSize > 0
+}
+
+// flags returns the flags byte stored in the item's cell
+func (i *Item) flags() byte {
+	var flags byte
+	if i.isOverflow() {
+		flags |= itemFlagOverflow
+	}
+	if i.collection {
+		flags |= itemFlagCollection
+	}
+	return flags
+}
+
+// size returns the number of bytes the item takes inside a page: its cell, its offset and a child node pointer.
+func (i *Item) size() int {
+	return offsetSize + i.cellSize() + pageNumSize
+}
+
+// cellSize returns the number of bytes of the item's cell: the lengths of the key and the value, the key, the item
+// flags and either the value or the first page of its overflow chain.
+func (i *Item) cellSize() int {
+	size := 0
+	size += uvarintSize(len(i.key)) + len(i.key)
+	size += itemFlagsSize
+	if i.isOverflow() {
+		size += uvarintSize(i.overflowSize) + pageNumSize
+	} else {
+		size += uvarintSize(len(i.value)) + len(i.value)
+	}
+	return size
+}
+
 func isLast(index int, parentNode *Node) bool {
 	return index == len(parentNode.items)
 }
@@ -86,7 +159,7 @@ func (n *Node) isUnderPopulated() bool {
 
 func (n *Node) serialize(buf []byte) []byte {
 	leftPos := 0
-	rightPos := len(buf) - 1
+	rightPos := len(buf)
 
 	// Add page header: isLeaf, key-value pairs count, node num
 	// isLeaf
@@ -123,25 +196,28 @@ func (n *Node) serialize(buf []byte) []byte {
 			leftPos += pageNumSize
 		}
 
-		klen := len(item.key)
-		vlen := len(item.value)
+		// The cell is written from the right: the key length as a varint, the key, the item flags, the value length
+		// as a varint and either the value or the first page of its overflow chain.
+		rightPos -= item.cellSize()
 
 		// write offset
-		offset := rightPos - klen - vlen - 2
-		binary.LittleEndian.PutUint16(buf[leftPos:], uint16(offset))
-		leftPos += 2
-
-		rightPos -= vlen
-		copy(buf[rightPos:], item.value)
-
-		rightPos -= 1
-		buf[rightPos] = byte(vlen)
-
-		rightPos -= klen
-		copy(buf[rightPos:], item.key)
-
-		rightPos -= 1
-		buf[rightPos] = byte(klen)
+		binary.LittleEndian.PutUint16(buf[leftPos:], uint16(rightPos))
+		leftPos += offsetSize
+
+		cellPos := rightPos
+		cellPos += binary.PutUvarint(buf[cellPos:], uint64(len(item.key)))
+		cellPos += copy(buf[cellPos:], item.key)
+
+		buf[cellPos] = item.flags()
+		cellPos += itemFlagsSize
+
+		if item.isOverflow() {
+			cellPos += binary.PutUvarint(buf[cellPos:], uint64(item.overflowSize))
+			binary.LittleEndian.PutUint64(buf[cellPos:], uint64(item.overflowPage))
+		} else {
+			cellPos += binary.PutUvarint(buf[cellPos:], uint64(len(item.value)))
+			copy(buf[cellPos:], item.value)
+		}
 	}
 
 	if !isLeaf {
@@ -154,10 +230,18 @@ func (n *Node) serialize(buf []byte) []byte {
 	return buf
 }
 
-func (n *Node) deserialize(buf []byte) {
+// errMalformedNode is returned when deserializing a buffer that doesn't hold a valid node.
+var errMalformedNode = errors.New("malformed node")
+
+// deserialize reads a node from the buffer. Every offset and length read from the buffer is checked against its size,
+// so a malformed buffer returns errMalformedNode instead of panicking.
+func (n *Node) deserialize(buf []byte) error {
 	leftPos := 0
 
 	// Read header
+	if len(buf) < nodeHeaderSize {
+		return errMalformedNode
+	}
 	isLeaf := uint16(buf[0])
 
 	itemsCount := int(binary.LittleEndian.Uint16(buf[1:3]))
@@ -166,6 +250,9 @@ func (n *Node) deserialize(buf []byte) {
 	// Read body
 	for i := 0; i < itemsCount; i++ {
 		if isLeaf == 0 { // False
+			if leftPos+pageNumSize > len(buf) {
+				return errMalformedNode
+			}
 			pgNum := binary.LittleEndian.Uint64(buf[leftPos:])
 			leftPos += pageNumSize
 
@@ -173,38 +260,83 @@ func (n *Node) deserialize(buf []byte) {
 		}
 
 		// Read offset
-		offset := binary.LittleEndian.Uint16(buf[leftPos:])
-		leftPos += 2
+		if leftPos+offsetSize > len(buf) {
+			return errMalformedNode
+		}
+		offset := int(binary.LittleEndian.Uint16(buf[leftPos:]))
+		leftPos += offsetSize
 
-		klen := uint16(buf[int(offset)])
-		offset += 1
+		if offset >= len(buf) {
+			return errMalformedNode
+		}
+		klen, read := binary.Uvarint(buf[offset:])
+		if read <= 0 || klen > uint64(len(buf)-offset-read) {
+			return errMalformedNode
+		}
+		offset += read
 
-		key := buf[offset : offset+klen]
-		offset += klen
+		key := buf[offset : offset+int(klen)]
+		offset += int(klen)
 
-		vlen := uint16(buf[int(offset)])
-		offset += 1
+		if offset >= len(buf) {
+			return errMalformedNode
+		}
+		flags := buf[offset]
+		offset += itemFlagsSize
 
-		value := buf[offset : offset+vlen]
-		offset += vlen
-		n.items = append(n.items, newItem(key, value))
+		if offset >= len(buf) {
+			return errMalformedNode
+		}
+		vlen, read := binary.Uvarint(buf[offset:])
+		if read <= 0 {
+			return errMalformedNode
+		}
+		offset += read
+
+		var item *Item
+		if flags&itemFlagOverflow != 0 {
+			if offset+pageNumSize > len(buf) || vlen > math.MaxInt32 {
+				return errMalformedNode
+			}
+			item = newItem(key, nil)
+			item.overflowSize = int(vlen)
+			item.overflowPage = pageNum(binary.LittleEndian.Uint64(buf[offset:]))
+		} else {
+			if vlen > uint64(len(buf)-offset) {
+				return errMalformedNode
+			}
+			item = newItem(key, buf[offset:offset+int(vlen)])
+		}
+		item.collection = flags&itemFlagCollection != 0
+		n.items = append(n.items, item)
 	}
 
 	if isLeaf == 0 { // False
 		// Read the last child node
+		if leftPos+pageNumSize > len(buf) {
+			return errMalformedNode
+		}
 		pageNum := pageNum(binary.LittleEndian.Uint64(buf[leftPos:]))
 		n.childNodes = append(n.childNodes, pageNum)
 	}
+
+	return nil
 }
 
 // elementSize returns the size of a key-value-childNode triplet at a given index.
 // If the node is a leaf, then the size of a key-value pair is returned.
 // It's assumed i <= len(n.items)
 func (n *Node) elementSize(i int) int {
-	size := 0
-	size += len(n.items[i].key)
-	size += len(n.items[i].value)
-	size += pageNumSize // 8 is the pageNum size
+	return n.items[i].size()
+}
+
+// uvarintSize returns the number of bytes needed to encode x as a varint.
+func uvarintSize(x int) int {
+	size := 1
+	for x >= 0x80 {
+		x >>= 7
+		size++
+	}
 	return size
 }
 
@@ -306,14 +438,22 @@ func (n *Node) split(nodeToSplit *Node, nodeToSplitIndex int) {
 	// index after.
 	splitIndex := nodeToSplit.tx.db.getSplitIndex(nodeToSplit)
 
+	// With big items, the min amount may be achieved only by the last item, or not at all before it. The item before
+	// the last one moves up to the parent then, so the new node isn't left empty.
+	if splitIndex == -1 || splitIndex > len(nodeToSplit.items)-2 {
+		splitIndex = len(nodeToSplit.items) - 2
+	}
+
 	middleItem := nodeToSplit.items[splitIndex]
 	var newNode *Node
 
+	// The new node gets copies of the items and children, so inserting into the split node later doesn't overwrite
+	// them through the shared arrays
 	if nodeToSplit.isLeaf() {
-		newNode = n.writeNode(n.tx.newNode(nodeToSplit.items[splitIndex+1:], []pageNum{}))
+		newNode = n.writeNode(n.tx.newNode(slices.Clone(nodeToSplit.items[splitIndex+1:]), []pageNum{}))
 		nodeToSplit.items = nodeToSplit.items[:splitIndex]
 	} else {
-		newNode = n.writeNode(n.tx.newNode(nodeToSplit.items[splitIndex+1:], nodeToSplit.childNodes[splitIndex+1:]))
+		newNode = n.writeNode(n.tx.newNode(slices.Clone(nodeToSplit.items[splitIndex+1:]), slices.Clone(nodeToSplit.childNodes[splitIndex+1:])))
 		nodeToSplit.items = nodeToSplit.items[:splitIndex]
 		nodeToSplit.childNodes = nodeToSplit.childNodes[:splitIndex+1]
 	}
@@ -364,18 +504,65 @@ func (n *Node) rebalancedRemove(unbalancedNode *Node, unbalancedNodeIndex int) e
 	// The merge function merges a given node with its node to the right. So by default, we merge an unbalanced node
 	// with its right sibling. In the case where the unbalanced node is the leftmost, we have to replace the merge
 	// parameters, so the unbalanced node right sibling, will be merged into the unbalanced node.
+	//
+	// The nodes aren't merged if the merged node would be over-populated, which may happen when the items are big.
+	// Items are rotated from the sibling into the unbalanced node instead.
 	if unbalancedNodeIndex == 0 {
 		rightNode, err := n.getNode(n.childNodes[unbalancedNodeIndex+1])
 		if err != nil {
 			return err
 		}
 
+		if !n.canMerge(unbalancedNode, rightNode, n.items[unbalancedNodeIndex]) {
+			n.redistribute(unbalancedNode, rightNode, unbalancedNodeIndex, false)
+			return nil
+		}
 		return pNode.merge(rightNode, unbalancedNodeIndex+1)
 	}
 
+	leftNode, err := n.getNode(pNode.childNodes[unbalancedNodeIndex-1])
+	if err != nil {
+		return err
+	}
+	if !n.canMerge(leftNode, unbalancedNode, n.items[unbalancedNodeIndex-1]) {
+		n.redistribute(unbalancedNode, leftNode, unbalancedNodeIndex, true)
+		return nil
+	}
 	return pNode.merge(unbalancedNode, unbalancedNodeIndex)
 }
 
+// redistribute rotates items from a sibling that can't spare an element, and can't be merged with the unbalanced node
+// either, into the unbalanced node. Items are rotated as long as the unbalanced node is under-populated and doesn't end
+// bigger than its sibling, and at least once if it's empty, so it's never left without items. The sibling is the node
+// to the left of the unbalanced node if fromLeft is true, and the node to its right otherwise.
+func (n *Node) redistribute(unbalancedNode, sibling *Node, unbalancedNodeIndex int, fromLeft bool) {
+	for unbalancedNode.isUnderPopulated() && len(sibling.items) > 1 {
+		// The sibling gives an item to the parent, and the unbalanced node takes the separator from the parent
+		separatorIndex, siblingIndex := unbalancedNodeIndex, 0
+		if fromLeft {
+			separatorIndex, siblingIndex = unbalancedNodeIndex-1, len(sibling.items)-1
+		}
+		unbalancedSize := unbalancedNode.nodeSize() + n.elementSize(separatorIndex)
+		siblingSize := sibling.nodeSize() - sibling.elementSize(siblingIndex)
+		if len(unbalancedNode.items) > 0 && unbalancedSize > siblingSize {
+			break
+		}
+
+		if fromLeft {
+			rotateRight(sibling, n, unbalancedNode, unbalancedNodeIndex)
+		} else {
+			rotateLeft(unbalancedNode, n, sibling, unbalancedNodeIndex)
+		}
+	}
+	n.writeNodes(sibling, n, unbalancedNode)
+}
+
+// canMerge checks if the node merged from aNode, the separator and bNode fits in a page.
+func (n *Node) canMerge(aNode, bNode *Node, separator *Item) bool {
+	size := aNode.nodeSize() + bNode.nodeSize() - nodeHeaderSize - pageNumSize + separator.size()
+	return float32(size) <= n.tx.db.maxThreshold()
+}
+
 // removeItemFromLeaf removes an item from a leaf node. It means there is no handling of child nodes.
 func (n *Node) removeItemFromLeaf(index int) {
 	n.items = append(n.items[:index], n.items[index+1:]...)
@@ -402,8 +589,8 @@ func (n *Node) removeItemFromInternal(index int) ([]int, error) {
 	}
 
 	for !aNode.isLeaf() {
-		traversingIndex := len(n.childNodes) - 1
-		aNode, err = n.getNode(n.childNodes[traversingIndex])
+		traversingIndex := len(aNode.childNodes) - 1
+		aNode, err = n.getNode(aNode.childNodes[traversingIndex])
 		if err != nil {
 			return nil, err
 		}
@@ -502,6 +689,6 @@ func (n *Node) merge(bNode *Node, bNodeIndex int) error {
 	}
 
 	n.writeNodes(aNode, n)
-	n.tx.db.deleteNode(bNode.pgNum)
+	n.tx.deleteNode(bNode)
 	return nil
 }
@@ -1,4 +1,4 @@
-package main
+package gonosql
 
 import (
 	"bytes"
@@ -859,12 +859,17 @@ func Test_FindNode(t *testing.T) {
 
 	root := tx.writeNode(tx.newNode(createItems("8"), []pageNum{child0.pgNum, child1.pgNum}))
 
-	collection, err := tx.createCollection(newCollection(testCollectionName, root.pgNum))
+	_, err := tx.createCollection(newCollection(testCollectionName, root.pgNum))
 	require.NoError(t, err)
 
 	err = tx.Commit()
 	require.NoError(t, err)
 
+	tx = db.ReadTx()
+	defer tx.Commit()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
 	// Item found
 	expectedVal := createItem("c")
 	expectedItem := newItem(expectedVal, expectedVal)
@@ -953,7 +958,7 @@ func TestDeserializeWithoutChildNodes(t *testing.T) {
 	require.NoError(t, err)
 
 	actualNode := NewEmptyNode()
-	actualNode.deserialize(page)
+	require.NoError(t, actualNode.deserialize(page))
 
 	items := []*Item{newItem([]byte("key1"), []byte("val1")), newItem([]byte("key2"), []byte("val2"))}
 	var childNodes []pageNum
@@ -992,6 +997,33 @@ func TestDeserializeWithChildNodes(t *testing.T) {
 	}
 
 	actualNode := NewEmptyNode()
-	actualNode.deserialize(page)
+	require.NoError(t, actualNode.deserialize(page))
 	assert.Equal(t, expectedNode, actualNode)
 }
+
+func TestDeserializeMalformedNode(t *testing.T) {
+	items := []*Item{newItem([]byte("key1"), []byte("val1")), newItem([]byte("key2"), []byte("val2"))}
+	node := &Node{
+		items:      items,
+		childNodes: []pageNum{1, 2, 3},
+	}
+	buf := node.serialize(make([]byte, 128))
+
+	// Truncated buffers and garbage offsets and lengths return an error instead of panicking
+	for size := 0; size < len(buf); size++ {
+		assert.NotPanics(t, func() {
+			_ = NewEmptyNode().deserialize(buf[:size])
+		})
+	}
+
+	for i := range buf {
+		corrupt := bytes.Clone(buf)
+		corrupt[i] = 0xff
+		assert.NotPanics(t, func() {
+			_ = NewEmptyNode().deserialize(corrupt)
+		})
+	}
+
+	assert.ErrorIs(t, NewEmptyNode().deserialize(buf[:2]), errMalformedNode)
+	assert.ErrorIs(t, NewEmptyNode().deserialize(buf[:20]), errMalformedNode)
+}
@@ -0,0 +1,138 @@
+package gonosql
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Values that are too big to be stored inline are written into a chain of overflow pages. The body of every page of the
+// chain starts with the number of the next page in the chain (0 for the last page) followed by a part of the value.
+//
+// ----------------------------------------
+// |  next page  |      value part        |
+// ----------------------------------------
+
+// overflowPageCapacity returns the number of value bytes a single overflow page holds.
+func (d *dal) overflowPageCapacity() int {
+	return d.bodySize() - pageNumSize
+}
+
+// overflowPagesCount returns the number of pages in the overflow chain of a value of the given size.
+func (d *dal) overflowPagesCount(size int) int {
+	capacity := d.overflowPageCapacity()
+	return (size + capacity - 1) / capacity
+}
+
+// writeOverflow stores the value in a chain of newly allocated overflow pages and returns the first page of the chain.
+// The pages are kept in the transaction and are written to the disk on commit.
+func (tx *Tx) writeOverflow(value []byte) pageNum {
+	capacity := tx.db.overflowPageCapacity()
+	count := tx.db.overflowPagesCount(len(value))
+
+	// The chain is allocated as a run of consecutive pages, so reading it back is sequential
+	start := tx.allocatePages(count)
+	pgNums := make([]pageNum, count)
+	for i := range pgNums {
+		pgNums[i] = start + pageNum(i)
+	}
+
+	for i, pgNum := range pgNums {
+		p := tx.db.allocateEmptyPage()
+		p.num = pgNum
+
+		var next pageNum
+		if i < len(pgNums)-1 {
+			next = pgNums[i+1]
+		}
+		body := p.body()
+		binary.LittleEndian.PutUint64(body, uint64(next))
+
+		start := i * capacity
+		end := min(start+capacity, len(value))
+		copy(body[pageNumSize:], value[start:end])
+		p.seal(pageTypeOverflow)
+
+		tx.dirtyPages[pgNum] = p
+	}
+
+	return pgNums[0]
+}
+
+// readOverflow reads a value of the given size from the overflow chain starting at the given page.
+func (tx *Tx) readOverflow(pgNum pageNum, size int) ([]byte, error) {
+	value := make([]byte, 0, size)
+	err := tx.walkOverflow(pgNum, size, func(_ pageNum, body []byte) {
+		end := min(pageNumSize+size-len(value), len(body))
+		value = append(value, body[pageNumSize:end]...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// freeOverflow walks the overflow chain of a value of the given size, starting at the given page, and marks all of its
+// pages for deletion. The pages are released only once the transaction commits.
+func (tx *Tx) freeOverflow(pgNum pageNum, size int) error {
+	return tx.walkOverflow(pgNum, size, func(pgNum pageNum, _ []byte) {
+		delete(tx.dirtyPages, pgNum)
+		tx.pagesToDelete = append(tx.pagesToDelete, pgNum)
+	})
+}
+
+// walkOverflow calls fn with every page of the overflow chain of a value of the given size, starting at the given page.
+// The walk is bounded by the number of pages the value needs, so a corrupt chain, like a cyclic one, returns an
+// ErrCorruptPage instead of being walked forever.
+func (tx *Tx) walkOverflow(pgNum pageNum, size int, fn func(pgNum pageNum, body []byte)) error {
+	count := tx.db.overflowPagesCount(size)
+	for i := 0; i < count; i++ {
+		body, err := tx.readOverflowPage(pgNum)
+		if err != nil {
+			return err
+		}
+		fn(pgNum, body)
+
+		next := pageNum(binary.LittleEndian.Uint64(body))
+		if next == 0 && i < count-1 {
+			return &ErrCorruptPage{PageNum: uint64(pgNum),
+				Reason: fmt.Sprintf("overflow chain ends after %d pages, but its value takes %d pages", i+1, count)}
+		}
+		if next != 0 && i == count-1 {
+			return &ErrCorruptPage{PageNum: uint64(pgNum),
+				Reason: fmt.Sprintf("overflow chain goes on past the %d pages its value takes", count)}
+		}
+		pgNum = next
+	}
+
+	return nil
+}
+
+// readOverflowPage reads and verifies a page of an overflow chain, and returns its body.
+func (tx *Tx) readOverflowPage(pgNum pageNum) ([]byte, error) {
+	p, err := tx.readPage(pgNum)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.verify(pageTypeOverflow)
+	if err != nil {
+		return nil, err
+	}
+	return p.body(), nil
+}
+
+// loadValue reads the value of an overflow item from its chain. Inline items are returned as is.
+func (tx *Tx) loadValue(item *Item) (*Item, error) {
+	if !item.isOverflow() || item.value != nil {
+		return item, nil
+	}
+
+	value, err := tx.readOverflow(item.overflowPage, item.overflowSize)
+	if err != nil {
+		return nil, err
+	}
+
+	item.value = value
+	return item, nil
+}
@@ -0,0 +1,324 @@
+package gonosql
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// overflowChain returns the pages of the overflow chain the value of the given key is stored in.
+func overflowChain(t *testing.T, collection *Collection, key []byte) []pageNum {
+	root, err := collection.tx.getNode(collection.root)
+	require.NoError(t, err)
+
+	index, node, _, err := root.findKey(key, true)
+	require.NoError(t, err)
+	require.True(t, node.items[index].isOverflow())
+
+	pgNums := make([]pageNum, 0)
+	for pgNum := node.items[index].overflowPage; pgNum != 0; {
+		pgNums = append(pgNums, pgNum)
+		p, err := collection.tx.readPage(pgNum)
+		require.NoError(t, err)
+		pgNum = pageNum(binary.LittleEndian.Uint64(p.body()))
+	}
+
+	return pgNums
+}
+
+func TestOverflow_PutAndFind(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	value := memset([]byte("0123456789"), 3*testPageSize)
+	err = collection.Put(key, value)
+	require.NoError(t, err)
+
+	item, err := collection.Find(key)
+	require.NoError(t, err)
+	assert.Equal(t, value, item.Value())
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	tx = db.ReadTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	item, err = collection.Find(key)
+	require.NoError(t, err)
+	assert.Equal(t, key, item.Key())
+	assert.Equal(t, value, item.Value())
+
+	err = tx.Commit()
+	require.NoError(t, err)
+}
+
+func TestOverflow_RemoveReleasesPages(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	value := memset([]byte("v"), 2*testPageSize)
+	err = collection.Put(key, value)
+	require.NoError(t, err)
+
+	chain := overflowChain(t, collection, key)
+	assert.Len(t, chain, 2*testPageSize/db.overflowPageCapacity()+1)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	tx = db.WriteTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	err = collection.Remove(key)
+	require.NoError(t, err)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	assert.Subset(t, db.releasedPages, chain)
+}
+
+func TestOverflow_OverwriteReleasesPages(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	value := memset([]byte("v"), 2*testPageSize)
+	err = collection.Put(key, value)
+	require.NoError(t, err)
+
+	chain := overflowChain(t, collection, key)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	tx = db.WriteTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	newValue := []byte("small value")
+	err = collection.Put(key, newValue)
+	require.NoError(t, err)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	assert.Subset(t, db.releasedPages, chain)
+
+	tx = db.ReadTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	item, err := collection.Find(key)
+	require.NoError(t, err)
+	assert.Equal(t, newValue, item.Value())
+
+	err = tx.Commit()
+	require.NoError(t, err)
+}
+
+func TestOverflow_Rollback(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	_, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	releasedPages, maxPage := slices.Clone(db.releasedPages), db.maxPage
+
+	tx = db.WriteTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	value := memset([]byte("v"), 2*testPageSize)
+	err = collection.Put(key, value)
+	require.NoError(t, err)
+
+	tx.Rollback()
+
+	// The overflow pages allocated by the transaction are given back
+	assertPagesReleased(t, db, releasedPages, maxPage)
+
+	tx = db.ReadTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	item, err := collection.Find(key)
+	require.NoError(t, err)
+	assert.Nil(t, item)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+}
+
+func TestOverflow_ChainIsContiguous(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	err = collection.Put(key, memset([]byte("v"), 5*db.overflowPageCapacity()))
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	// The first commit released single pages, like the old root collection page. The new chain skips them for a long
+	// enough run.
+	require.NotEmpty(t, db.releasedPages)
+	releasedPages := slices.Clone(db.releasedPages)
+
+	tx = db.WriteTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	value := memset([]byte("w"), 3*db.overflowPageCapacity())
+	err = collection.Put(key, value)
+	require.NoError(t, err)
+
+	chain := overflowChain(t, collection, key)
+	require.Len(t, chain, 3)
+	for i := 1; i < len(chain); i++ {
+		assert.Equal(t, chain[i-1]+1, chain[i])
+	}
+	assert.NotContains(t, releasedPages, chain[0])
+	require.NoError(t, tx.Commit())
+
+	tx = db.ReadTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	item, err := collection.Find(key)
+	require.NoError(t, err)
+	assert.Equal(t, value, item.Value())
+	require.NoError(t, tx.Commit())
+}
+
+func TestOverflow_ValueTooLargeToStoreInline(t *testing.T) {
+	// The inline threshold allows values that don't fit in a node, which are stored in overflow pages instead
+	db, err := Open(getTempFileName(), &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage,
+		MaxInlineValueSize: 2000})
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	inline, overflow := []byte("inline"), []byte("overflow")
+	require.NoError(t, collection.Put(inline, memset([]byte("v"), 500)))
+	require.NoError(t, collection.Put(overflow, memset([]byte("v"), 1500)))
+	assert.Len(t, overflowChain(t, collection, overflow), 1)
+	require.NoError(t, tx.Commit())
+
+	tx = db.ReadTx()
+	defer tx.Rollback()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	root, err := tx.getNode(collection.root)
+	require.NoError(t, err)
+	index, node, _, err := root.findKey(inline, true)
+	require.NoError(t, err)
+	assert.False(t, node.items[index].isOverflow())
+
+	item, err := collection.Find(overflow)
+	require.NoError(t, err)
+	assert.Equal(t, memset([]byte("v"), 1500), item.Value())
+}
+
+func TestOverflow_CorruptChain(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// next returns the page the page at the given index of the chain is rewritten to link to
+		next func(chain []pageNum, i int) pageNum
+	}{
+		{
+			name: "cyclic",
+			next: func(chain []pageNum, i int) pageNum {
+				return chain[(i+1)%len(chain)]
+			},
+		},
+		{
+			name: "short",
+			next: func(chain []pageNum, i int) pageNum {
+				if i == 0 {
+					return 0
+				}
+				return chain[(i+1)%len(chain)]
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, cleanFunc := createTestDB(t)
+			defer cleanFunc()
+
+			key := []byte("key")
+			err := db.Update(func(tx *Tx) error {
+				collection, err := tx.CreateCollection(testCollectionName)
+				require.NoError(t, err)
+				return collection.Put(key, memset([]byte("v"), 3*testPageSize))
+			})
+			require.NoError(t, err)
+
+			tx := db.ReadTx()
+			collection, err := tx.GetCollection(testCollectionName)
+			require.NoError(t, err)
+			chain := overflowChain(t, collection, key)
+			require.NoError(t, tx.Rollback())
+
+			for i, pgNum := range chain {
+				p, err := db.readPage(pgNum)
+				require.NoError(t, err)
+				binary.LittleEndian.PutUint64(p.body(), uint64(test.next(chain, i)))
+				p.seal(pageTypeOverflow)
+				require.NoError(t, db.writePage(p))
+			}
+
+			// The walks over the chain stop at the number of pages the value takes
+			var corruptErr *ErrCorruptPage
+			err = db.View(func(tx *Tx) error {
+				collection, err := tx.GetCollection(testCollectionName)
+				require.NoError(t, err)
+				_, err = collection.Find(key)
+				return err
+			})
+			assert.ErrorAs(t, err, &corruptErr)
+
+			err = db.Update(func(tx *Tx) error {
+				collection, err := tx.GetCollection(testCollectionName)
+				require.NoError(t, err)
+				return collection.Remove(key)
+			})
+			assert.ErrorAs(t, err, &corruptErr)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package gonosql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// pageType is the kind of content a page holds. It's stored in the page header, so a page read where another kind of
+// page is expected is detected.
+type pageType byte
+
+const (
+	pageTypeMeta pageType = iota + 1
+	pageTypeFreelist
+	pageTypeNode
+	pageTypeOverflow
+)
+
+func (t pageType) String() string {
+	switch t {
+	case pageTypeMeta:
+		return "meta"
+	case pageTypeFreelist:
+		return "freelist"
+	case pageTypeNode:
+		return "node"
+	case pageTypeOverflow:
+		return "overflow"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(t))
+	}
+}
+
+// Every page starts with a header holding a checksum of the rest of the page, the type of the page and its number.
+// The content of the page, its body, follows the header.
+// ---------------------------------------------------------
+// | checksum | page type | page number |       body       |
+// ---------------------------------------------------------
+const pageHeaderSize = checksumSize + pageTypeSize + pageNumSize
+
+// ErrCorruptPage is returned when a page read from the disk doesn't pass verification: its checksum doesn't match its
+// content, it isn't of the expected type, it belongs to another page number, or its content is malformed.
+type ErrCorruptPage struct {
+	PageNum uint64
+	Reason  string
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("corrupt page %d: %s", e.PageNum, e.Reason)
+}
+
+// body returns the content of the page, after its header.
+func (p *page) body() []byte {
+	return p.data[pageHeaderSize:]
+}
+
+// seal writes the header of a page whose body is complete. It must be called again if the body changes.
+func (p *page) seal(t pageType) {
+	p.data[checksumSize] = byte(t)
+	binary.LittleEndian.PutUint64(p.data[checksumSize+pageTypeSize:], uint64(p.num))
+	binary.LittleEndian.PutUint32(p.data, pageChecksum(p.data))
+}
+
+// verify checks the header of a page read from the disk. An ErrCorruptPage is returned if the page isn't a sealed page
+// of the given type and number.
+func (p *page) verify(t pageType) error {
+	if binary.LittleEndian.Uint32(p.data) != pageChecksum(p.data) {
+		return &ErrCorruptPage{PageNum: uint64(p.num), Reason: "checksum mismatch"}
+	}
+
+	if actual := pageType(p.data[checksumSize]); actual != t {
+		return &ErrCorruptPage{PageNum: uint64(p.num), Reason: fmt.Sprintf("expected a %s page, found a %s page", t, actual)}
+	}
+
+	if actual := pageNum(binary.LittleEndian.Uint64(p.data[checksumSize+pageTypeSize:])); actual != p.num {
+		return &ErrCorruptPage{PageNum: uint64(p.num), Reason: fmt.Sprintf("page holds the content of page %d", actual)}
+	}
+
+	return nil
+}
+
+func pageChecksum(data []byte) uint32 {
+	return crc32.Checksum(data[checksumSize:], castagnoliTable)
+}
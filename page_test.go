@@ -0,0 +1,148 @@
+package gonosql
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestPage(pgNum pageNum, t pageType) *page {
+	p := &page{num: pgNum, data: make([]byte, testPageSize)}
+	copy(p.body(), "body of the page")
+	p.seal(t)
+	return p
+}
+
+func assertCorruptPage(t *testing.T, err error, pgNum pageNum) {
+	var corrupt *ErrCorruptPage
+	require.True(t, errors.As(err, &corrupt), "expected a corrupt page error, got %v", err)
+	assert.Equal(t, uint64(pgNum), corrupt.PageNum)
+}
+
+func TestPage_Verify(t *testing.T) {
+	p := createTestPage(5, pageTypeNode)
+	require.NoError(t, p.verify(pageTypeNode))
+
+	// A page of another type
+	assertCorruptPage(t, p.verify(pageTypeFreelist), 5)
+
+	// A page written to the wrong place
+	misplaced := &page{num: 6, data: p.data}
+	assertCorruptPage(t, misplaced.verify(pageTypeNode), 6)
+
+	// A flipped bit anywhere in the page
+	for _, i := range []int{0, checksumSize, pageHeaderSize, testPageSize - 1} {
+		corrupt := &page{num: 5, data: append([]byte(nil), p.data...)}
+		corrupt.data[i] ^= 1
+		assertCorruptPage(t, corrupt.verify(pageTypeNode), 5)
+	}
+
+	// A page that was never written
+	assertCorruptPage(t, (&page{num: 5, data: make([]byte, testPageSize)}).verify(pageTypeNode), 5)
+}
+
+// corruptTestPage flips the last byte of a page of the database file.
+func corruptTestPage(t *testing.T, path string, pgNum pageNum) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	defer file.Close()
+
+	offset := int64(pgNum+1)*int64(os.Getpagesize()) - 1
+	b := make([]byte, 1)
+	_, err = file.ReadAt(b, offset)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = file.WriteAt(b, offset)
+	require.NoError(t, err)
+}
+
+func TestPage_CorruptNode(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+	putTestItems(t, db, "0")
+
+	tx := db.ReadTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	root := collection.root
+	require.NoError(t, tx.Commit())
+	require.NoError(t, db.Close())
+
+	corruptTestPage(t, path, root)
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx = db.ReadTx()
+	defer tx.Commit()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	_, err = collection.Find(createItem("0"))
+	assertCorruptPage(t, err, root)
+}
+
+func TestPage_CorruptOverflow(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(key, memset([]byte("v"), 2*testPageSize)))
+	chain := overflowChain(t, collection, key)
+	require.NoError(t, tx.Commit())
+	require.NoError(t, db.Close())
+
+	corruptTestPage(t, path, chain[1])
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx = db.ReadTx()
+	defer tx.Commit()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	_, err = collection.Find(key)
+	assertCorruptPage(t, err, chain[1])
+}
+
+func TestPage_CorruptFreelist(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+	freelistPage := db.freelistPage
+	require.NoError(t, db.Close())
+
+	corruptTestPage(t, path, freelistPage)
+	_, err = Open(path, options)
+	assertCorruptPage(t, err, freelistPage)
+}
+
+func TestPage_CorruptMeta(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+	putTestItems(t, db, "0")
+	require.NoError(t, db.Close())
+
+	// A single corrupt meta page is skipped, since the other one is still valid
+	corruptTestPage(t, path, 0)
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	assertTestItems(t, db, true, "0")
+	require.NoError(t, db.Close())
+
+	corruptTestPage(t, path, 1)
+	_, err = Open(path, options)
+	assertCorruptPage(t, err, 0)
+}
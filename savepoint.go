@@ -0,0 +1,158 @@
+package gonosql
+
+import (
+	"maps"
+	"slices"
+)
+
+// Savepoint is the state of a write transaction at some point, which the transaction can be rolled back to without
+// discarding its earlier changes. It's created by Tx.Savepoint.
+type Savepoint struct {
+	tx *Tx
+
+	dirtyNodes        map[pageNum]*Node
+	dirtyPages        map[pageNum]*page
+	touchedPages      map[pageNum]struct{}
+	pagesToDelete     int
+	allocatedPageNums int
+
+	// rootCollection is the state of the root collection and of the collections opened through it, or nil if the
+	// root collection wasn't used yet.
+	rootCollection *collectionState
+}
+
+// collectionState is the state of a collection opened in a transaction, and of the collections opened through it.
+type collectionState struct {
+	collection *Collection
+
+	name             []byte
+	root             pageNum
+	counter          uint64
+	persistedRoot    pageNum
+	persistedCounter uint64
+	collections      []*collectionState
+}
+
+// Savepoint records the current state of the transaction, so it can be rolled back to it later with RollbackTo.
+// Savepoints can be nested: rolling back to a savepoint or releasing it does the same to the savepoints created after
+// it.
+func (tx *Tx) Savepoint() (*Savepoint, error) {
+	if err := tx.writable(); err != nil {
+		return nil, err
+	}
+
+	sp := &Savepoint{
+		tx:                tx,
+		dirtyNodes:        cloneNodes(tx.dirtyNodes),
+		dirtyPages:        maps.Clone(tx.dirtyPages),
+		touchedPages:      maps.Clone(tx.touchedPages),
+		pagesToDelete:     len(tx.pagesToDelete),
+		allocatedPageNums: len(tx.allocatedPageNums),
+	}
+	if tx.rootCollection != nil {
+		sp.rootCollection = saveCollection(tx.rootCollection)
+	}
+
+	tx.savepoints = append(tx.savepoints, sp)
+	return sp, nil
+}
+
+// RollbackTo discards the changes made since the savepoint was created, and the savepoints created after it. The
+// savepoint itself is kept, so the transaction can be rolled back to it again. The pages allocated since the
+// savepoint are released, while the transaction keeps the write lock. Nodes, cursors and collections obtained after
+// the savepoint mustn't be used anymore.
+func (tx *Tx) RollbackTo(sp *Savepoint) error {
+	i, err := tx.savepointIndex(sp)
+	if err != nil {
+		return err
+	}
+
+	for _, pgNum := range tx.allocatedPageNums[sp.allocatedPageNums:] {
+		tx.db.releasePage(pgNum)
+	}
+	tx.allocatedPageNums = tx.allocatedPageNums[:sp.allocatedPageNums]
+	tx.pagesToDelete = tx.pagesToDelete[:sp.pagesToDelete]
+
+	// The savepoint keeps its own copies, since the restored nodes are going to be modified
+	tx.dirtyNodes = cloneNodes(sp.dirtyNodes)
+	for _, node := range tx.dirtyNodes {
+		node.tx = tx
+	}
+	tx.dirtyPages = maps.Clone(sp.dirtyPages)
+	tx.touchedPages = maps.Clone(sp.touchedPages)
+
+	tx.rootCollection = nil
+	if sp.rootCollection != nil {
+		tx.rootCollection = sp.rootCollection.restore()
+	}
+
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release discards the savepoint and the savepoints created after it, keeping the changes made since then.
+func (tx *Tx) Release(sp *Savepoint) error {
+	i, err := tx.savepointIndex(sp)
+	if err != nil {
+		return err
+	}
+
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+// savepointIndex returns the position of the savepoint in the savepoints of the transaction. ErrSavepointNotFound is
+// returned if it was released, rolled back past, or created by another transaction.
+func (tx *Tx) savepointIndex(sp *Savepoint) (int, error) {
+	if err := tx.writable(); err != nil {
+		return 0, err
+	}
+
+	i := slices.Index(tx.savepoints, sp)
+	if i == -1 {
+		return 0, ErrSavepointNotFound
+	}
+	return i, nil
+}
+
+func cloneNodes(nodes map[pageNum]*Node) map[pageNum]*Node {
+	clones := make(map[pageNum]*Node, len(nodes))
+	for pgNum, node := range nodes {
+		clones[pgNum] = node.clone()
+	}
+	return clones
+}
+
+func saveCollection(c *Collection) *collectionState {
+	state := &collectionState{
+		collection:       c,
+		name:             c.name,
+		root:             c.root,
+		counter:          c.counter,
+		persistedRoot:    c.persistedRoot,
+		persistedCounter: c.persistedCounter,
+	}
+	for _, child := range c.collections {
+		state.collections = append(state.collections, saveCollection(child))
+	}
+	return state
+}
+
+// restore sets the collection back to its saved state, and forgets the collections opened through it since then.
+func (s *collectionState) restore() *Collection {
+	c := s.collection
+	c.name = s.name
+	c.root = s.root
+	c.counter = s.counter
+	c.persistedRoot = s.persistedRoot
+	c.persistedCounter = s.persistedCounter
+
+	c.collections = nil
+	if len(s.collections) > 0 {
+		c.collections = make(map[string]*Collection, len(s.collections))
+		for _, child := range s.collections {
+			c.collections[string(child.name)] = child.restore()
+		}
+	}
+	return c
+}
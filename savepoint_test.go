@@ -0,0 +1,165 @@
+package gonosql
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertCollectionKeys checks the collection holds exactly the given test items, in order.
+func assertCollectionKeys(t *testing.T, collection *Collection, keys ...string) {
+	var expected, actual [][]byte
+	for _, key := range keys {
+		expected = append(expected, createItem(key))
+	}
+
+	err := collection.Scan(nil, nil, nil, func(item *Item) bool {
+		actual = append(actual, item.Key())
+		assert.Equal(t, item.Key(), item.Value())
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestSavepoint_RollbackTo(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	putTestItems(t, db, "0", "1", "2", "3")
+
+	tx := db.WriteTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("4"), createItem("4")))
+	id := collection.ID()
+
+	sp, err := tx.Savepoint()
+	require.NoError(t, err)
+	allocated := len(tx.allocatedPageNums)
+
+	// Enough changes to split and merge nodes, create collections and use ids
+	for i := 5; i < 10; i++ {
+		key := createItem(strconv.Itoa(i))
+		require.NoError(t, collection.Put(key, key))
+	}
+	require.NoError(t, collection.Remove(createItem("0")))
+	require.NoError(t, collection.Remove(createItem("1")))
+	collection.ID()
+	_, err = tx.CreateCollection([]byte("other"))
+	require.NoError(t, err)
+	_, err = collection.CreateCollection([]byte("nested"))
+	require.NoError(t, err)
+
+	allocatedAfter := slices.Clone(tx.allocatedPageNums[allocated:])
+	require.NotEmpty(t, allocatedAfter)
+	require.NoError(t, tx.RollbackTo(sp))
+
+	// The pages allocated after the savepoint are released, while the write lock is still held
+	assert.Len(t, tx.allocatedPageNums, allocated)
+	assert.Subset(t, db.releasedPages, allocatedAfter)
+	assert.False(t, db.writeLock.TryLock())
+
+	assertCollectionKeys(t, collection, "0", "1", "2", "3", "4")
+	assert.Equal(t, id+1, collection.ID())
+	other, err := tx.GetCollection([]byte("other"))
+	require.NoError(t, err)
+	assert.Nil(t, other)
+	nested, err := collection.GetCollection([]byte("nested"))
+	require.NoError(t, err)
+	assert.Nil(t, nested)
+
+	// The transaction goes on after the rollback
+	require.NoError(t, collection.Put(createItem("5"), createItem("5")))
+	require.NoError(t, tx.Commit())
+
+	tx = db.ReadTx()
+	defer tx.Commit()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	assertCollectionKeys(t, collection, "0", "1", "2", "3", "4", "5")
+	assert.Equal(t, id+2, collection.counter)
+}
+
+func TestSavepoint_Nested(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	putTestItems(t, db, "0")
+
+	tx := db.WriteTx()
+	defer tx.Rollback()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	sp1, err := tx.Savepoint()
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("1"), createItem("1")))
+
+	sp2, err := tx.Savepoint()
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("2"), createItem("2")))
+
+	sp3, err := tx.Savepoint()
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("3"), createItem("3")))
+
+	require.NoError(t, tx.RollbackTo(sp2))
+	assertCollectionKeys(t, collection, "0", "1")
+	assert.ErrorIs(t, tx.RollbackTo(sp3), ErrSavepointNotFound)
+
+	// A savepoint can be rolled back to more than once
+	require.NoError(t, collection.Put(createItem("4"), createItem("4")))
+	require.NoError(t, tx.RollbackTo(sp2))
+	assertCollectionKeys(t, collection, "0", "1")
+
+	require.NoError(t, tx.RollbackTo(sp1))
+	assertCollectionKeys(t, collection, "0")
+	assert.ErrorIs(t, tx.Release(sp2), ErrSavepointNotFound)
+}
+
+func TestSavepoint_Release(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	putTestItems(t, db, "0")
+
+	tx := db.WriteTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	sp1, err := tx.Savepoint()
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("1"), createItem("1")))
+	sp2, err := tx.Savepoint()
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("2"), createItem("2")))
+
+	// Releasing a savepoint releases the ones created after it, and keeps the changes
+	require.NoError(t, tx.Release(sp1))
+	assert.ErrorIs(t, tx.RollbackTo(sp1), ErrSavepointNotFound)
+	assert.ErrorIs(t, tx.RollbackTo(sp2), ErrSavepointNotFound)
+	assertCollectionKeys(t, collection, "0", "1", "2")
+	require.NoError(t, tx.Commit())
+
+	assertTestItems(t, db, true, "0", "1", "2")
+
+	// Savepoints belong to their transaction
+	tx = db.WriteTx()
+	defer tx.Rollback()
+	assert.ErrorIs(t, tx.Release(sp1), ErrSavepointNotFound)
+}
+
+func TestSavepoint_ReadTx(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.ReadTx()
+	defer tx.Commit()
+
+	_, err := tx.Savepoint()
+	assert.ErrorIs(t, err, ErrWriteInsideReadTx)
+}
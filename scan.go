@@ -0,0 +1,149 @@
+package gonosql
+
+import "bytes"
+
+// ScanOptions controls the items a scan visits and their order.
+type ScanOptions struct {
+	// ExcludeStart and ExcludeEnd make the bounds of the range exclusive. They are inclusive by default.
+	ExcludeStart bool
+	ExcludeEnd   bool
+
+	// Reverse visits the items from the end of the range to its start.
+	Reverse bool
+
+	// Offset is the number of items in the range to skip before the first visited item.
+	Offset int
+
+	// Limit is the maximum number of items to visit. When it's zero, there's no limit.
+	Limit int
+}
+
+// Scan calls fn for every item with a key between start and end, in key order or in reverse order. A nil start or
+// end leaves the range open on that side. The scan stops early when fn returns false. The scan seeks directly to the
+// first item of the range instead of walking the collection from its first item.
+func (c *Collection) Scan(start, end []byte, opts *ScanOptions, fn func(item *Item) bool) error {
+	if err := c.tx.checkOpen(); err != nil {
+		return err
+	}
+
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+
+	cursor := c.Cursor()
+	item, err := cursor.seekStart(start, end, opts)
+
+	// The scan stops at the end of the range, or at its start in reverse order
+	next, stop, stopExclusive := cursor.Next, end, opts.ExcludeEnd
+	if opts.Reverse {
+		next, stop, stopExclusive = cursor.Prev, start, opts.ExcludeStart
+	}
+
+	skipped, visited := 0, 0
+	for ; item != nil; item, err = next() {
+		if err != nil {
+			return err
+		}
+
+		if stop != nil && !inRange(item.key, stop, opts.Reverse, stopExclusive) {
+			return nil
+		}
+
+		if skipped < opts.Offset {
+			skipped++
+			continue
+		}
+
+		if !fn(item) {
+			return nil
+		}
+
+		visited++
+		if opts.Limit > 0 && visited == opts.Limit {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// ScanPrefix calls fn for every item whose key starts with the given prefix, the same way Scan does. The bounds
+// options are ignored.
+func (c *Collection) ScanPrefix(prefix []byte, opts *ScanOptions, fn func(item *Item) bool) error {
+	scanOpts := ScanOptions{}
+	if opts != nil {
+		scanOpts = *opts
+	}
+
+	// The range ends right before the smallest key bigger than all the keys with the prefix
+	scanOpts.ExcludeStart = false
+	scanOpts.ExcludeEnd = true
+	return c.Scan(prefix, prefixEnd(prefix), &scanOpts, fn)
+}
+
+// seekStart positions the cursor on the first item the scan visits, which is the last item of the range in reverse
+// order.
+func (cur *Cursor) seekStart(start, end []byte, opts *ScanOptions) (*Item, error) {
+	if !opts.Reverse {
+		if start == nil {
+			return cur.First()
+		}
+
+		item, err := cur.Seek(start)
+		if err != nil || item == nil {
+			return item, err
+		}
+
+		if opts.ExcludeStart && bytes.Equal(item.key, start) {
+			return cur.Next()
+		}
+		return item, nil
+	}
+
+	if end == nil {
+		return cur.Last()
+	}
+
+	// Seek returns the first item that isn't smaller than the end of the range, so the last item in the range is
+	// either it or the one before it
+	item, err := cur.Seek(end)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return cur.Last()
+	}
+
+	if !inRange(item.key, end, false, opts.ExcludeEnd) {
+		return cur.Prev()
+	}
+	return item, nil
+}
+
+// inRange returns whether the key is on the inner side of the given bound. For a scan in key order the bound is the
+// end of the range, and for a reverse scan it's the start.
+func inRange(key, bound []byte, reverse bool, exclusive bool) bool {
+	res := bytes.Compare(key, bound)
+	if reverse {
+		res = -res
+	}
+
+	if exclusive {
+		return res < 0
+	}
+	return res <= 0
+}
+
+// prefixEnd returns the smallest key that is bigger than all the keys starting with the prefix. nil is returned if
+// there's no such key, like when the prefix is made only of 0xff bytes.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package gonosql
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestScanCollection(t *testing.T, db *DB) (*Tx, *Collection, []string) {
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	keys := []string{"a", "b", "c"}
+	for _, user := range []string{"1", "2", "3", "4"} {
+		for _, session := range []string{"a", "b", "c", "d", "e", "f"} {
+			keys = append(keys, "user:"+user+":"+session)
+		}
+	}
+	keys = append(keys, "v", "w", "\xff", "\xff\xff")
+
+	for i := range keys {
+		key := []byte(keys[(i*5)%len(keys)])
+		err = collection.Put(key, memset(key, testValSize/len(key)))
+		require.NoError(t, err)
+	}
+
+	return tx, collection, keys
+}
+
+func scanKeys(t *testing.T, collection *Collection, start, end string, opts *ScanOptions) []string {
+	var startKey, endKey []byte
+	if start != "" {
+		startKey = []byte(start)
+	}
+	if end != "" {
+		endKey = []byte(end)
+	}
+
+	keys := make([]string, 0)
+	err := collection.Scan(startKey, endKey, opts, func(item *Item) bool {
+		assert.Equal(t, memset(item.Key(), testValSize/len(item.Key())), item.Value())
+		keys = append(keys, string(item.Key()))
+		return true
+	})
+	require.NoError(t, err)
+	return keys
+}
+
+func scanPrefixKeys(t *testing.T, collection *Collection, prefix string, opts *ScanOptions) []string {
+	keys := make([]string, 0)
+	err := collection.ScanPrefix([]byte(prefix), opts, func(item *Item) bool {
+		keys = append(keys, string(item.Key()))
+		return true
+	})
+	require.NoError(t, err)
+	return keys
+}
+
+func reversed(keys []string) []string {
+	keys = slices.Clone(keys)
+	slices.Reverse(keys)
+	return keys
+}
+
+func TestScan_Range(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection, keys := createTestScanCollection(t, db)
+	defer tx.Rollback()
+
+	// Open range
+	assert.Equal(t, keys, scanKeys(t, collection, "", "", nil))
+	assert.Equal(t, reversed(keys), scanKeys(t, collection, "", "", &ScanOptions{Reverse: true}))
+
+	// Bounds that exist
+	expected := []string{"user:2:a", "user:2:b", "user:2:c", "user:2:d", "user:2:e", "user:2:f", "user:3:a"}
+	for _, opts := range []ScanOptions{{}, {ExcludeStart: true}, {ExcludeEnd: true}, {ExcludeStart: true, ExcludeEnd: true}} {
+		expected := expected
+		if opts.ExcludeStart {
+			expected = expected[1:]
+		}
+		if opts.ExcludeEnd {
+			expected = expected[:len(expected)-1]
+		}
+
+		assert.Equal(t, expected, scanKeys(t, collection, "user:2:a", "user:3:a", &opts))
+		opts.Reverse = true
+		assert.Equal(t, reversed(expected), scanKeys(t, collection, "user:2:a", "user:3:a", &opts))
+	}
+
+	// Bounds that don't exist are exclusive either way
+	expected = []string{"user:1:f", "user:2:a"}
+	assert.Equal(t, expected, scanKeys(t, collection, "user:1:e0", "user:2:a0", nil))
+	assert.Equal(t, reversed(expected), scanKeys(t, collection, "user:1:e0", "user:2:a0", &ScanOptions{Reverse: true}))
+
+	// Half-open ranges
+	assert.Equal(t, keys[:4], scanKeys(t, collection, "", "user:1:a", nil))
+	assert.Equal(t, reversed(keys[:4]), scanKeys(t, collection, "", "user:1:a", &ScanOptions{Reverse: true}))
+	assert.Equal(t, keys[len(keys)-3:], scanKeys(t, collection, "w", "", nil))
+	assert.Equal(t, reversed(keys[len(keys)-3:]), scanKeys(t, collection, "w", "", &ScanOptions{Reverse: true}))
+
+	// Empty ranges
+	assert.Empty(t, scanKeys(t, collection, "b0", "b1", nil))
+	assert.Empty(t, scanKeys(t, collection, "b0", "b1", &ScanOptions{Reverse: true}))
+	assert.Empty(t, scanKeys(t, collection, "c", "b", nil))
+	assert.Empty(t, scanKeys(t, collection, "c", "b", &ScanOptions{Reverse: true}))
+	assert.Empty(t, scanKeys(t, collection, "0", "0", nil))
+	assert.Empty(t, scanKeys(t, collection, "\xff\xff\xff", "", nil))
+	assert.Empty(t, scanKeys(t, collection, "", "0", &ScanOptions{Reverse: true}))
+}
+
+func TestScan_LimitAndOffset(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection, keys := createTestScanCollection(t, db)
+	defer tx.Rollback()
+
+	assert.Equal(t, keys[:5], scanKeys(t, collection, "", "", &ScanOptions{Limit: 5}))
+	assert.Equal(t, keys[3:8], scanKeys(t, collection, "", "", &ScanOptions{Offset: 3, Limit: 5}))
+	assert.Equal(t, keys[len(keys)-2:], scanKeys(t, collection, "", "", &ScanOptions{Offset: len(keys) - 2, Limit: 5}))
+	assert.Empty(t, scanKeys(t, collection, "", "", &ScanOptions{Offset: len(keys)}))
+	assert.Equal(t, reversed(keys)[3:8], scanKeys(t, collection, "", "", &ScanOptions{Offset: 3, Limit: 5, Reverse: true}))
+}
+
+func TestScan_StopEarly(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection, keys := createTestScanCollection(t, db)
+	defer tx.Rollback()
+
+	visited := make([]string, 0)
+	err := collection.Scan(nil, nil, nil, func(item *Item) bool {
+		visited = append(visited, string(item.Key()))
+		return len(visited) < 3
+	})
+	require.NoError(t, err)
+	assert.Equal(t, keys[:3], visited)
+}
+
+func TestScan_Prefix(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx, collection, keys := createTestScanCollection(t, db)
+	require.NoError(t, tx.Commit())
+
+	tx = db.ReadTx()
+	defer tx.Rollback()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	expected := []string{"user:2:a", "user:2:b", "user:2:c", "user:2:d", "user:2:e", "user:2:f"}
+	assert.Equal(t, expected, scanPrefixKeys(t, collection, "user:2:", nil))
+	assert.Equal(t, reversed(expected), scanPrefixKeys(t, collection, "user:2:", &ScanOptions{Reverse: true}))
+	assert.Equal(t, expected[1:3], scanPrefixKeys(t, collection, "user:2:", &ScanOptions{Offset: 1, Limit: 2}))
+
+	// Bounds options are ignored
+	assert.Equal(t, expected, scanPrefixKeys(t, collection, "user:2:", &ScanOptions{ExcludeStart: true}))
+
+	assert.Equal(t, keys, scanPrefixKeys(t, collection, "", nil))
+	assert.Equal(t, []string{"\xff", "\xff\xff"}, scanPrefixKeys(t, collection, "\xff", nil))
+	assert.Equal(t, []string{"\xff\xff", "\xff"}, scanPrefixKeys(t, collection, "\xff", &ScanOptions{Reverse: true}))
+	assert.Empty(t, scanPrefixKeys(t, collection, "user:5:", nil))
+	assert.Empty(t, scanPrefixKeys(t, collection, "user:5:", &ScanOptions{Reverse: true}))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("user:3"), prefixEnd([]byte("user:2")))
+	assert.Equal(t, []byte("b"), prefixEnd([]byte("a\xff\xff")))
+	assert.Nil(t, prefixEnd([]byte("\xff\xff")))
+	assert.Nil(t, prefixEnd([]byte("")))
+}
@@ -0,0 +1,64 @@
+package gonosql
+
+// CollectionStats describes the shape of a collection's B-tree and how well its pages are filled.
+type CollectionStats struct {
+	// KeyCount is the number of items in the collection, nested collections included.
+	KeyCount int
+
+	// Depth is the number of levels of the tree. A collection whose root is a leaf has a depth of 1.
+	Depth int
+
+	LeafPages   int
+	BranchPages int
+
+	// BytesUsed is the number of bytes taken by the nodes in their pages. Values stored in overflow pages only count
+	// for the page number pointing to them.
+	BytesUsed int
+
+	// FillFactor is the ratio between BytesUsed and the space nodes can take in their pages, which excludes the page
+	// headers.
+	FillFactor float64
+}
+
+// Stats walks the tree of the collection and returns its statistics.
+func (c *Collection) Stats() (*CollectionStats, error) {
+	if err := c.tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	stats := &CollectionStats{}
+	err := c.nodeStats(c.root, 1, stats)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := stats.LeafPages + stats.BranchPages
+	if pages > 0 {
+		stats.FillFactor = float64(stats.BytesUsed) / float64(pages*c.tx.db.bodySize())
+	}
+	return stats, nil
+}
+
+func (c *Collection) nodeStats(pgNum pageNum, depth int, stats *CollectionStats) error {
+	node, err := c.tx.getNode(pgNum)
+	if err != nil {
+		return err
+	}
+
+	stats.KeyCount += len(node.items)
+	stats.BytesUsed += node.nodeSize()
+	stats.Depth = max(stats.Depth, depth)
+	if node.isLeaf() {
+		stats.LeafPages++
+		return nil
+	}
+
+	stats.BranchPages++
+	for _, child := range node.childNodes {
+		err = c.nodeStats(child, depth+1, stats)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package gonosql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollection_Stats(t *testing.T) {
+	collection, cleanFunc := createTestMockTree(t)
+	defer cleanFunc()
+
+	tx := collection.tx.db.ReadTx()
+	defer tx.Commit()
+
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	stats, err := collection.Stats()
+	require.NoError(t, err)
+
+	root, err := tx.getNode(collection.root)
+	require.NoError(t, err)
+	expectedBytes := root.nodeSize()
+	for _, child := range root.childNodes {
+		node, err := tx.getNode(child)
+		require.NoError(t, err)
+		expectedBytes += node.nodeSize()
+	}
+
+	assert.Equal(t, 10, stats.KeyCount)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 3, stats.LeafPages)
+	assert.Equal(t, 1, stats.BranchPages)
+	assert.Equal(t, expectedBytes, stats.BytesUsed)
+	assert.InDelta(t, float64(expectedBytes)/float64(4*tx.db.bodySize()), stats.FillFactor, 1e-9)
+}
+
+func TestCollection_StatsEmpty(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	defer tx.Rollback()
+
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	stats, err := collection.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.KeyCount)
+	assert.Equal(t, 1, stats.Depth)
+	assert.Equal(t, 1, stats.LeafPages)
+	assert.Equal(t, 0, stats.BranchPages)
+}
@@ -0,0 +1,161 @@
+package gonosql
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// SyncMode sets when commits are synced to the disk.
+type SyncMode int
+
+const (
+	// SyncAlways syncs every commit to the disk before Commit returns. It's the default.
+	SyncAlways SyncMode = iota
+
+	// SyncGroup syncs commits in the background, at most Options.GroupCommitDelay after they were made, so a batch of
+	// commits shares a single sync, or two outside of WAL mode, where the meta page of the batch is written by the
+	// background sync. A crash may lose the commits made since the last sync, but the database is left in the state of
+	// the last synced commit.
+	SyncGroup
+
+	// SyncNone never syncs the database. It's meant for bulk loads, since a crash may lose or corrupt the database.
+	SyncNone
+)
+
+const defaultGroupCommitDelay = 10 * time.Millisecond
+
+var errSyncerClosed = errors.New("database is closed")
+
+// groupSyncer syncs the commits made in SyncGroup mode in the background. The first commit after a sync schedules the
+// next one, and all the commits made until it runs are synced together.
+type groupSyncer struct {
+	mu    sync.Mutex
+	delay time.Duration
+	timer *time.Timer
+
+	// sync syncs a batch of commits, given the id of the latest synced commit and the metas of the commits made since,
+	// oldest first. It returns the id of the latest commit known to be on the disk, which may be part of the batch even
+	// if it fails.
+	sync func(synced uint64, metas []*meta) (uint64, error)
+
+	// metas holds the metas of the commits that weren't synced yet, oldest first, and syncedTxid is the id of the
+	// latest commit known to be on the disk.
+	metas      []*meta
+	syncedTxid uint64
+
+	// err holds the error of a failed background sync. It's returned by the next commit.
+	err    error
+	closed bool
+}
+
+func newGroupSyncer(delay time.Duration, txid uint64, sync func(synced uint64, metas []*meta) (uint64, error)) *groupSyncer {
+	if delay <= 0 {
+		delay = defaultGroupCommitDelay
+	}
+
+	return &groupSyncer{
+		delay:      delay,
+		sync:       sync,
+		syncedTxid: txid,
+	}
+}
+
+// commit records a commit that was written but not synced, and schedules a sync if none is pending. The error of a
+// previous background sync is returned, if it failed.
+func (s *groupSyncer) commit(meta *meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		err := s.err
+		s.err = nil
+		return err
+	}
+
+	s.metas = append(s.metas, meta)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.delay, s.backgroundSync)
+	}
+	return nil
+}
+
+func (s *groupSyncer) backgroundSync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timer = nil
+	if s.closed {
+		return
+	}
+
+	err := s.syncLocked()
+	if err != nil {
+		s.err = err
+	}
+}
+
+// syncLocked syncs all the commits made so far. The lock must be held.
+func (s *groupSyncer) syncLocked() error {
+	if len(s.metas) == 0 {
+		return nil
+	}
+
+	txid, err := s.sync(s.syncedTxid, s.metas)
+	synced := 0
+	for synced < len(s.metas) && s.metas[synced].txid <= txid {
+		synced++
+	}
+	s.metas = s.metas[synced:]
+	s.syncedTxid = max(s.syncedTxid, txid)
+	return err
+}
+
+// flush syncs the pending commits now, instead of waiting for the background sync. The error of a previous background
+// sync is returned, if it failed.
+func (s *groupSyncer) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		err := s.err
+		s.err = nil
+		return err
+	}
+	return s.syncLocked()
+}
+
+// synced returns the id of the latest commit known to be on the disk.
+func (s *groupSyncer) synced() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.syncedTxid
+}
+
+// close syncs the pending commits and stops the syncer.
+func (s *groupSyncer) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errSyncerClosed
+	}
+	s.closed = true
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.syncLocked()
+}
+
+// pendingPages are pages released by a commit that may still be read.
+type pendingPages struct {
+	txid  uint64
+	pages []pageNum
+}
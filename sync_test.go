@@ -0,0 +1,219 @@
+package gonosql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSyncerMeta returns the meta of a commit passed to a groupSyncer.
+func testSyncerMeta(txid uint64) *meta {
+	meta := newEmptyMeta()
+	meta.txid = txid
+	return meta
+}
+
+// countingSync returns a sync function for a groupSyncer that counts its calls and syncs the whole batch.
+func countingSync(syncs *atomic.Int32) func(synced uint64, metas []*meta) (uint64, error) {
+	return func(synced uint64, metas []*meta) (uint64, error) {
+		syncs.Add(1)
+		return metas[len(metas)-1].txid, nil
+	}
+}
+
+func TestGroupSyncer_SyncsCommitsTogether(t *testing.T) {
+	var syncs atomic.Int32
+	s := newGroupSyncer(20*time.Millisecond, 1, countingSync(&syncs))
+
+	for txid := uint64(2); txid <= 5; txid++ {
+		require.NoError(t, s.commit(testSyncerMeta(txid)))
+	}
+	assert.Equal(t, uint64(1), s.synced())
+
+	assert.Eventually(t, func() bool {
+		return s.synced() == 5
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), syncs.Load())
+
+	require.NoError(t, s.close())
+	assert.Equal(t, int32(1), syncs.Load())
+}
+
+func TestGroupSyncer_ReturnsSyncErrorOnNextCommit(t *testing.T) {
+	syncErr := errors.New("sync failed")
+	s := newGroupSyncer(time.Millisecond, 1, func(synced uint64, metas []*meta) (uint64, error) {
+		return synced, syncErr
+	})
+
+	require.NoError(t, s.commit(testSyncerMeta(2)))
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.err != nil
+	}, time.Second, time.Millisecond)
+
+	assert.ErrorIs(t, s.commit(testSyncerMeta(3)), syncErr)
+	assert.Equal(t, uint64(1), s.synced())
+}
+
+func TestGroupSyncer_CloseSyncsPendingCommits(t *testing.T) {
+	var syncs atomic.Int32
+	s := newGroupSyncer(time.Hour, 1, countingSync(&syncs))
+
+	require.NoError(t, s.commit(testSyncerMeta(2)))
+	require.NoError(t, s.close())
+	assert.Equal(t, int32(1), syncs.Load())
+	assert.Equal(t, uint64(2), s.synced())
+	assert.ErrorIs(t, s.close(), errSyncerClosed)
+}
+
+func TestDB_SyncGroupDefersPageReuse(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, SyncMode: SyncGroup,
+		GroupCommitDelay: time.Hour}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0", "1")
+	oldRoot, oldFreelistPage := db.root, db.freelistPage
+	putTestItems(t, db, "2")
+
+	// The commit isn't synced, so the pages it released still belong to the meta page on the disk
+	assert.NotContains(t, db.releasedPages, oldRoot)
+	assert.NotContains(t, db.releasedPages, oldFreelistPage)
+	require.Len(t, db.pendingPages, 2)
+	persistedFreelist := db.committedFreelist(nil)
+	assert.Contains(t, persistedFreelist.releasedPages, oldRoot)
+	assert.Contains(t, persistedFreelist.releasedPages, oldFreelistPage)
+
+	// Once synced, the pages are reused
+	s := db.syncer
+	s.mu.Lock()
+	require.NoError(t, s.syncLocked())
+	s.mu.Unlock()
+
+	tx := db.WriteTx()
+	assert.Empty(t, db.pendingPages)
+	assert.Contains(t, db.releasedPages, oldRoot)
+	assert.Contains(t, db.releasedPages, oldFreelistPage)
+	tx.Rollback()
+
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assertTestItems(t, db, true, "0", "1", "2")
+}
+
+func TestDB_SyncNone(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, SyncMode: SyncNone}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0", "1", "2")
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assertTestItems(t, db, true, "0", "1", "2")
+}
+
+func TestDB_SyncGroupBatchesSyncs(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%t", wal), func(t *testing.T) {
+			path := getTempFileName()
+			options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, SyncMode: SyncGroup,
+				GroupCommitDelay: time.Hour, WAL: wal}
+			db, err := Open(path, options)
+			require.NoError(t, err)
+
+			syncs := 0
+			db.writeHook = func(step writeStep) error {
+				if step == writeStepBarrier || step == writeStepSync {
+					syncs++
+				}
+				return nil
+			}
+
+			const commits = 10
+			for i := 0; i < commits; i++ {
+				putTestItems(t, db, strconv.Itoa(i))
+			}
+			assert.Zero(t, syncs)
+
+			// The log only has to be synced, while the file is synced before and after the meta page is written. When
+			// the latest meta page would overwrite the synced one, the commit before it is synced first.
+			require.NoError(t, db.flushSync())
+			if wal {
+				assert.Equal(t, 1, syncs)
+			} else {
+				assert.Equal(t, 3, syncs)
+			}
+			assert.Equal(t, db.txid, db.syncer.synced())
+
+			// An odd number of commits has its meta page in the other meta page
+			putTestItems(t, db, "odd")
+			syncs = 0
+			require.NoError(t, db.flushSync())
+			if wal {
+				assert.Equal(t, 1, syncs)
+			} else {
+				assert.Equal(t, 2, syncs)
+			}
+
+			require.NoError(t, db.Close())
+			db, err = Open(path, options)
+			require.NoError(t, err)
+			defer db.Close()
+			assertTestItems(t, db, true, "0", "5", "9", "odd")
+		})
+	}
+}
+
+func TestDB_SyncGroupFailedMetaWriteKeepsPreviousCommit(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, SyncMode: SyncGroup,
+		GroupCommitDelay: time.Hour}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0")
+	require.NoError(t, db.flushSync())
+
+	// The second commit of the batch has its meta page in the meta page of the synced commit, so the first commit of
+	// the batch is synced before it. Writing the meta page of the second commit fails.
+	putTestItems(t, db, "1")
+	putTestItems(t, db, "2")
+	metaWrites := 0
+	db.writeHook = func(step writeStep) error {
+		if step == writeStepMeta {
+			metaWrites++
+			if metaWrites == 2 {
+				return errInjected
+			}
+		}
+		return nil
+	}
+	require.ErrorIs(t, db.flushSync(), errInjected)
+	assert.Equal(t, db.txid-1, db.syncer.synced())
+
+	// The database is reopened as if the process crashed
+	require.NoError(t, db.file.Close())
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assertTestItems(t, db, true, "0", "1")
+	assertTestItems(t, db, false, "2")
+}
@@ -1,9 +1,10 @@
-package main
+package gonosql
 
 import (
 	"bytes"
 	"fmt"
 	"os"
+	"slices"
 	"testing"
 
 	"github.com/google/uuid"
@@ -73,6 +74,17 @@ func areTreesEqualHelper(t *testing.T, n1, n2 *Node) {
 	}
 }
 
+// assertPagesReleased checks that the freelist holds the given released pages, and all the pages allocated beyond the
+// given max page. It's used to make sure a transaction that was rolled back didn't leak pages.
+func assertPagesReleased(t *testing.T, db *DB, releasedPages []pageNum, maxPage pageNum) {
+	expected := slices.Clone(releasedPages)
+	for pgNum := maxPage + 1; pgNum <= db.maxPage; pgNum++ {
+		expected = append(expected, pgNum)
+	}
+
+	assert.ElementsMatch(t, expected, db.releasedPages)
+}
+
 func createTestMockTree(t *testing.T) (*Collection, func()) {
 	db, cleanFunc := createTestDB(t)
 
@@ -124,3 +136,45 @@ func createItems(keys ...string) []*Item {
 	}
 	return items
 }
+
+func putTestItems(t *testing.T, db *DB, keys ...string) {
+	tx := db.WriteTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	if collection == nil {
+		collection, err = tx.CreateCollection(testCollectionName)
+		require.NoError(t, err)
+	}
+
+	for _, key := range keys {
+		val := createItem(key)
+		err = collection.Put(val, val)
+		require.NoError(t, err)
+	}
+
+	err = tx.Commit()
+	require.NoError(t, err)
+}
+
+func assertTestItems(t *testing.T, db *DB, exist bool, keys ...string) {
+	tx := db.ReadTx()
+	defer func() {
+		require.NoError(t, tx.Commit())
+	}()
+
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	require.NotNil(t, collection)
+
+	for _, key := range keys {
+		val := createItem(key)
+		item, err := collection.Find(val)
+		require.NoError(t, err)
+		if exist {
+			require.NotNil(t, item, key)
+			assert.Equal(t, val, item.Value())
+		} else {
+			assert.Nil(t, item, key)
+		}
+	}
+}
@@ -1,39 +1,122 @@
-package main
+package gonosql
 
-type tx struct {
+import (
+	"fmt"
+	"time"
+)
+
+// Tx is a read-only or read-write transaction. It's created by DB.ReadTx or DB.WriteTx and has to be finished by either
+// calling Commit or Rollback.
+type Tx struct {
 	dirtyNodes    map[pageNum]*Node
 	pagesToDelete []pageNum
 
+	// pages written during the transaction, like overflow pages. They are written to the disk on commit.
+	dirtyPages map[pageNum]*page
+
 	// new pages allocated during the transaction. They will be released if rollback is called.
 	allocatedPageNums []pageNum
 
+	// pages of all the nodes read or written during the transaction. A modified node can only be reached from its
+	// collection root through them, so on commit only those pages are walked.
+	touchedPages map[pageNum]struct{}
+
+	// meta holds the state of the database the transaction started from. On commit, it's updated and written as the
+	// new meta page.
+	meta *meta
+
+	// the root collection, which holds the records of all the collections. It's created on first use.
+	rootCollection *Collection
+
 	write bool
 
+	// savepoints created during the transaction that weren't released or rolled back past, oldest first.
+	savepoints []*Savepoint
+
+	// closed is set once the transaction is committed or rolled back, after which it can't be used anymore.
+	closed bool
+
+	// leakTimer reports the transaction if it's left open for too long, only in debug mode. See Options.DebugTx.
+	leakTimer *time.Timer
+
+	// managed is set while the transaction is run by DB.Update or DB.View, which finish it themselves.
+	managed bool
+
 	db *DB
 }
 
-func newTx(db *DB, write bool) *tx {
-	return &tx{
-		map[pageNum]*Node{},
-		make([]pageNum, 0),
-		make([]pageNum, 0),
-		write,
-		db,
+func newTx(db *DB, write bool) *Tx {
+	meta := *db.meta
+	return &Tx{
+		dirtyNodes:        map[pageNum]*Node{},
+		pagesToDelete:     make([]pageNum, 0),
+		dirtyPages:        map[pageNum]*page{},
+		allocatedPageNums: make([]pageNum, 0),
+		touchedPages:      map[pageNum]struct{}{},
+		meta:              &meta,
+		write:             write,
+		db:                db,
+	}
+}
+
+// checkOpen returns ErrTxClosed if the transaction was committed or rolled back.
+func (tx *Tx) checkOpen() error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	return nil
+}
+
+// writable returns an error if the transaction can't perform write operations.
+func (tx *Tx) writable() error {
+	if err := tx.checkOpen(); err != nil {
+		return err
+	}
+	if tx.db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	return nil
+}
+
+// allocatePage returns a free page number. The page is released if the transaction is rolled back.
+func (tx *Tx) allocatePage() pageNum {
+	pgNum := tx.db.getNextPage()
+	tx.allocatedPageNums = append(tx.allocatedPageNums, pgNum)
+	return pgNum
+}
+
+// allocatePages returns the first of n consecutive free pages. The pages are released if the transaction is rolled
+// back.
+func (tx *Tx) allocatePages(n int) pageNum {
+	start := tx.db.getNextPages(n)
+	for i := 0; i < n; i++ {
+		tx.allocatedPageNums = append(tx.allocatedPageNums, start+pageNum(i))
 	}
+	return start
 }
 
-func (tx *tx) newNode(items []*Item, childNodes []pageNum) *Node {
+func (tx *Tx) newNode(items []*Item, childNodes []pageNum) *Node {
 	node := NewEmptyNode()
 	node.items = items
 	node.childNodes = childNodes
-	node.pgNum = tx.db.getNextPage()
+	node.pgNum = tx.allocatePage()
 	node.tx = tx
-
-	node.tx.allocatedPageNums = append(node.tx.allocatedPageNums, node.pgNum)
 	return node
 }
 
-func (tx *tx) getNode(pgNum pageNum) (*Node, error) {
+func (tx *Tx) readPage(pgNum pageNum) (*page, error) {
+	if p, ok := tx.dirtyPages[pgNum]; ok {
+		return p, nil
+	}
+
+	return tx.db.readPage(pgNum)
+}
+
+func (tx *Tx) getNode(pgNum pageNum) (*Node, error) {
+	tx.touchedPages[pgNum] = struct{}{}
 	if node, ok := tx.dirtyNodes[pgNum]; ok {
 		return node, nil
 	}
@@ -47,121 +130,258 @@ func (tx *tx) getNode(pgNum pageNum) (*Node, error) {
 	return node, nil
 }
 
-func (tx *tx) writeNode(node *Node) *Node {
+func (tx *Tx) writeNode(node *Node) *Node {
+	tx.touchedPages[node.pgNum] = struct{}{}
 	tx.dirtyNodes[node.pgNum] = node
 	node.tx = tx
 	return node
 }
 
-func (tx *tx) deleteNode(node *Node) {
+func (tx *Tx) deleteNode(node *Node) {
 	tx.pagesToDelete = append(tx.pagesToDelete, node.pgNum)
 }
 
-func (tx *tx) Rollback() {
+// Rollback discards the changes of the transaction. ErrTxClosed is returned if the transaction was already committed
+// or rolled back. Inside DB.Update and DB.View, ErrTxManaged is returned and the transaction is left open, since it's
+// rolled back by returning an error.
+func (tx *Tx) Rollback() error {
+	if err := tx.checkOpen(); err != nil {
+		return err
+	}
+	if tx.managed {
+		return ErrTxManaged
+	}
+
 	if !tx.write {
-		tx.db.rwLock.RUnlock()
-		return
+		tx.close()
+		return nil
 	}
 
-	tx.dirtyNodes = nil
-	tx.pagesToDelete = nil
+	tx.rollback()
+	return nil
+}
+
+// rollback releases the pages allocated by the write transaction and the write lock.
+func (tx *Tx) rollback() {
 	for _, pageNum := range tx.allocatedPageNums {
 		tx.db.freelist.releasePage(pageNum)
 	}
 
+	tx.close()
+}
+
+// close marks the transaction as finished and releases its lock. The state of a write transaction is cleared.
+func (tx *Tx) close() {
+	tx.closed = true
+	if tx.leakTimer != nil {
+		tx.leakTimer.Stop()
+	}
+
+	if !tx.write {
+		tx.db.closeReadTx(tx)
+		return
+	}
+
+	tx.dirtyNodes = nil
+	tx.dirtyPages = nil
+	tx.pagesToDelete = nil
 	tx.allocatedPageNums = nil
-	tx.db.rwLock.Unlock()
+	tx.savepoints = nil
+	tx.db.writeLock.Unlock()
 }
 
-func (tx *tx) Commit() error {
+// Commit writes the changes of the transaction to the disk using copy-on-write. Modified nodes are never written in
+// place. Instead, they are moved to new pages, and so are their ancestors up to the root collection. The old pages are
+// released only after a new meta page, pointing to the new tree, is written. This way a crash at any point of the
+// commit leaves the database in its state before or after the transaction.
+//
+// Commit is all or nothing: if it fails, the transaction is rolled back and the database stays in its state before the
+// transaction. In WAL mode, the log may be checkpointed after the commit, in which case an error of the checkpoint is
+// returned even though the transaction was committed.
+//
+// Commit returns ErrTxClosed if the transaction was already committed or rolled back, and ErrTxManaged inside
+// DB.Update and DB.View, which commit the transaction themselves.
+func (tx *Tx) Commit() error {
+	if err := tx.checkOpen(); err != nil {
+		return err
+	}
+	if tx.managed {
+		return ErrTxManaged
+	}
+
 	if !tx.write {
-		tx.db.rwLock.RUnlock()
+		tx.close()
 		return nil
 	}
 
-	for _, node := range tx.dirtyNodes {
-		_, err := tx.db.writeNode(node)
-		if err != nil {
-			return err
-		}
+	err := tx.commit()
+	if err != nil {
+		tx.rollback()
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	err = tx.db.autoCheckpoint()
+	tx.close()
+	if err != nil {
+		return fmt.Errorf("could not checkpoint the write-ahead log: %w", err)
 	}
+	return nil
+}
 
-	for _, pageNum := range tx.pagesToDelete {
-		tx.db.deleteNode(pageNum)
+// commit writes the changes of the transaction and publishes them. On error, nothing was published and the changes
+// are discarded by rolling back.
+func (tx *Tx) commit() error {
+	allocated := make(map[pageNum]struct{}, len(tx.allocatedPageNums))
+	for _, pgNum := range tx.allocatedPageNums {
+		allocated[pgNum] = struct{}{}
 	}
 
-	_, err := tx.db.writeFreelist()
+	rootCollection := tx.getRootCollection()
+	err := tx.spillCollection(rootCollection, allocated)
 	if err != nil {
 		return err
 	}
 
-	tx.dirtyNodes = nil
-	tx.pagesToDelete = nil
-	tx.allocatedPageNums = nil
-	tx.db.rwLock.Unlock()
+	// The freelist is moved to new pages as well. The persisted freelist already counts the pages released by the
+	// transaction as free, since they are unreachable from the new meta page. Allocating the pages of the chain can
+	// only shrink the freelist, so pages are allocated until the chain is long enough.
+	tx.pagesToDelete = append(tx.pagesToDelete, tx.db.freelist.pages...)
+	var freelistPages []pageNum
+	freelist := tx.db.committedFreelist(tx.pagesToDelete)
+	for len(freelistPages) < freelist.pagesCount(tx.db.bodySize()) {
+		freelistPages = append(freelistPages, tx.allocatePage())
+		freelist = tx.db.committedFreelist(tx.pagesToDelete)
+	}
+	for _, p := range tx.db.serializeFreelist(freelistPages, freelist) {
+		tx.dirtyPages[p.num] = p
+	}
+
+	// The new root of the root collection and the new freelist page are published together by the meta page, which is
+	// written last. Until then, the previous meta page still points to the previous tree and freelist. The meta of the
+	// transaction is a copy, so the database keeps its meta if writing fails.
+	meta := *tx.meta
+	meta.root = rootCollection.root
+	meta.freelistPage = freelistPages[0]
+	meta.txid += 1
+	err = tx.db.writeCommit(tx.dirtyPages, &meta)
+	if err != nil {
+		return err
+	}
+
+	tx.meta = &meta
+	tx.db.publishMeta(tx.meta)
+	tx.db.freelist.pages = freelistPages
+	tx.db.releaseCommittedPages(tx.meta.txid, tx.pagesToDelete, tx.db.oldestReader())
 	return nil
 }
 
-func (tx *tx) CreateCollection(name []byte) (*Collection, error) {
-	if !tx.write {
-		return nil, writeInsideReadTxErr
+// spillCollection moves the modified nodes of the collection, and of the collections opened through it, to new pages.
+// The collections opened through it are spilled first, and the records of those whose root or counter changed are
+// rewritten, so the collection itself is spilled with up-to-date records.
+func (tx *Tx) spillCollection(c *Collection, allocated map[pageNum]struct{}) error {
+	for _, child := range c.collections {
+		err := tx.spillCollection(child, allocated)
+		if err != nil {
+			return err
+		}
+
+		if child.isModified() {
+			err = child.persistIn(c)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	newCollectionPage, err := tx.db.writeNode(NewEmptyNode())
+	root, err := tx.spill(c.root, allocated)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	newCollection := newEmptyCollection()
-	newCollection.name = name
-	newCollection.root = newCollectionPage.pgNum
-	return tx.createCollection(newCollection)
+	c.root = root
+	return nil
 }
 
-func (tx *tx) createCollection(collection *Collection) (*Collection, error) {
-	collection.tx = tx
-	collectionBytes := collection.serialize()
+// spill walks the nodes touched by the transaction starting at the given page and serializes the modified ones into
+// the pages written on commit. A node that was modified, or one of whose children moved, is moved to a new page unless
+// the page was allocated by the transaction in the first place. The page the node ends up in is returned.
+func (tx *Tx) spill(pgNum pageNum, allocated map[pageNum]struct{}) (pageNum, error) {
+	if _, ok := tx.touchedPages[pgNum]; !ok {
+		return pgNum, nil
+	}
 
-	rootCollection := tx.getRootCollection()
-	err := rootCollection.Put(collection.name, collectionBytes.value)
+	node, err := tx.getNode(pgNum)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return collection, nil
-}
+	_, dirty := tx.dirtyNodes[pgNum]
+	for i, childNode := range node.childNodes {
+		newChildNode, err := tx.spill(childNode, allocated)
+		if err != nil {
+			return 0, err
+		}
 
-func (tx *tx) DeleteCollection(name []byte) error {
-	if !tx.write {
-		return writeInsideReadTxErr
+		if newChildNode != childNode {
+			node.childNodes[i] = newChildNode
+			dirty = true
+		}
 	}
 
-	rootCollection := tx.getRootCollection()
+	if !dirty {
+		return pgNum, nil
+	}
 
-	return rootCollection.Remove(name)
+	if _, ok := allocated[pgNum]; !ok {
+		tx.pagesToDelete = append(tx.pagesToDelete, pgNum)
+		node.pgNum = tx.allocatePage()
+	}
 
+	tx.dirtyPages[node.pgNum] = tx.db.serializeNode(node)
+	return node.pgNum, nil
 }
 
-func (tx *tx) getRootCollection() *Collection {
-	rootCollection := newEmptyCollection()
-	rootCollection.root = tx.db.root
-	rootCollection.tx = tx
-	return rootCollection
+// CreateCollection creates a collection in the root collection. ErrCollectionExists is returned if the collection
+// already exists.
+func (tx *Tx) CreateCollection(name []byte) (*Collection, error) {
+	return tx.getRootCollection().CreateCollection(name)
 }
 
-func (tx *tx) GetCollection(name []byte) (*Collection, error) {
-	rootCollection := tx.getRootCollection()
-	item, err := rootCollection.Find(name)
-	if err != nil {
-		return nil, err
-	}
+func (tx *Tx) createCollection(collection *Collection) (*Collection, error) {
+	return tx.getRootCollection().createCollection(collection)
+}
+
+func (tx *Tx) DeleteCollection(name []byte) error {
+	return tx.getRootCollection().DeleteCollection(name)
+}
+
+// RenameCollection moves a collection to a new name without copying its tree. ErrCollectionNotFound is returned if
+// there's no collection named oldName, and ErrCollectionExists if newName is already taken.
+func (tx *Tx) RenameCollection(oldName, newName []byte) error {
+	return tx.getRootCollection().RenameCollection(oldName, newName)
+}
 
-	if item == nil {
-		return nil, nil
+// ForEachCollection calls fn for every collection of the database, in name order. The iteration stops at the first
+// error returned by fn, and the error is returned.
+func (tx *Tx) ForEachCollection(fn func(name []byte, collection *Collection) error) error {
+	return tx.getRootCollection().ForEachCollection(fn)
+}
+
+// ListCollections returns the names of the collections of the database, in name order.
+func (tx *Tx) ListCollections() ([][]byte, error) {
+	return tx.getRootCollection().ListCollections()
+}
+
+func (tx *Tx) getRootCollection() *Collection {
+	if tx.rootCollection == nil {
+		tx.rootCollection = newEmptyCollection()
+		tx.rootCollection.root = tx.meta.root
+		tx.rootCollection.tx = tx
 	}
 
-	collection := newEmptyCollection()
-	collection.deserialize(item)
-	collection.tx = tx
-	return collection, nil
+	return tx.rootCollection
+}
+
+func (tx *Tx) GetCollection(name []byte) (*Collection, error) {
+	return tx.getRootCollection().GetCollection(name)
 }
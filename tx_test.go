@@ -1,7 +1,9 @@
-package main
+package gonosql
 
 import (
-	"sync"
+	"errors"
+	"slices"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -60,61 +62,57 @@ func TestTx_OpenMultipleReadTxSimultaneously(t *testing.T) {
 	err = tx2.Commit()
 }
 
-// TestTx_OpenReadAndWriteTxSimultaneously Validates read and write tx don't run simultaneously. It first starts a read
-// tx, then once the lock was acquired, a write transaction is started. Once the read tx finishes, the lock is released,
-// and the write tx start executing. Once the lock is acquired again, a read tx is triggered.
-// The nesting of the functions done to make sure the transactions are fired only after the lock is acquired to avoid
-// race conditions.
-// We expect the first read tx (tx1) not to see the changes done by the write tx (tx2) even when though it queries the database
-// after the write tx was triggered (Because of the lock).
-// And again, even though tx3 was triggered before tx2 committed the changes, it doesn't query the database yet since
-// the lock is already acquired. It will query the database only after tx2 makes the changes and releases the lock.
+// TestTx_OpenReadAndWriteTxSimultaneously validates read and write transactions run at the same time. A read tx (tx1)
+// is started, then a write tx (tx2) runs and commits in another goroutine while tx1 is still open. tx1 reads the
+// snapshot it started from, so it doesn't see the changes of tx2 even though it queries the database after tx2
+// committed. A read tx (tx3) started while tx2 is open doesn't see them either, and one (tx4) started after tx2
+// committed does.
 func TestTx_OpenReadAndWriteTxSimultaneously(t *testing.T) {
 	db, cleanFunc := createTestDB(t)
 	defer cleanFunc()
 
-	wg := sync.WaitGroup{}
-
 	tx1 := db.ReadTx()
 
-	// Start write tx only after the lock was acquired by the read tx
-	wg.Add(1)
+	committed := make(chan struct{})
+	var tx3 *Tx
 	go func() {
-		tx2 := db.WriteTx()
-
-		// Start read tx only after the lock was acquired by the write tx
-		wg.Add(1)
-		go func() {
-			tx3 := db.ReadTx()
-
-			collection3, err := tx3.GetCollection(testCollectionName)
-			require.NoError(t, err)
-			require.Equal(t, testCollectionName, collection3.name)
-
-			err = tx3.Commit()
-			wg.Done()
-		}()
+		defer close(committed)
 
+		tx2 := db.WriteTx()
 		_, err := tx2.CreateCollection(testCollectionName)
-		require.NoError(t, err)
+		assert.NoError(t, err)
+
+		tx3 = db.ReadTx()
 
-		err = tx2.Commit()
-		wg.Done()
+		assert.NoError(t, tx2.Commit())
 	}()
 
+	<-committed
+
 	collection1, err := tx1.GetCollection(testCollectionName)
 	require.NoError(t, err)
 	require.Nil(t, collection1)
+	require.NoError(t, tx1.Commit())
 
-	err = tx1.Commit()
+	collection3, err := tx3.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	require.Nil(t, collection3)
+	require.NoError(t, tx3.Commit())
 
-	wg.Wait()
+	tx4 := db.ReadTx()
+	collection4, err := tx4.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	require.NotNil(t, collection4)
+	require.Equal(t, testCollectionName, collection4.name)
+	require.NoError(t, tx4.Commit())
 }
 
 func TestTx_Rollback(t *testing.T) {
 	db, cleanFunc := createTestDB(t)
 	defer cleanFunc()
 
+	rootCollectionPage, freelistPage := db.root, db.freelistPage
+
 	tx := db.WriteTx()
 	child0 := tx.writeNode(tx.newNode(createItems("0", "1", "2", "3"), []pageNum{}))
 
@@ -128,7 +126,9 @@ func TestTx_Rollback(t *testing.T) {
 	err = tx.Commit()
 	require.NoError(t, err)
 
-	assert.Len(t, tx.db.freelist.releasedPages, 0)
+	// The root collection and the freelist were copied to new pages, so their old pages are free
+	assert.ElementsMatch(t, []pageNum{rootCollectionPage, freelistPage}, tx.db.freelist.releasedPages)
+	releasedPages, maxPage := slices.Clone(db.releasedPages), db.maxPage
 
 	// Try to add 9 but then perform a rollback, so it won't be saved
 	tx2 := db.WriteTx()
@@ -142,9 +142,8 @@ func TestTx_Rollback(t *testing.T) {
 
 	tx2.Rollback()
 
-	// 9 should not exist since a rollback was performed. A new page should be added to released page ids though, since
-	// a split occurred and a new page node was created, but later deleted.
-	assert.Len(t, tx2.db.freelist.releasedPages, 1)
+	// 9 should not exist since a rollback was performed. The page of the node created by the split is free again.
+	assertPagesReleased(t, db, releasedPages, maxPage)
 	tx3 := db.ReadTx()
 
 	collection, err = tx3.GetCollection(collection.name)
@@ -159,5 +158,488 @@ func TestTx_Rollback(t *testing.T) {
 	err = tx3.Commit()
 	require.NoError(t, err)
 
-	assert.Len(t, tx3.db.freelist.releasedPages, 1)
+	assertPagesReleased(t, db, releasedPages, maxPage)
+}
+
+func TestTx_CommitIsCopyOnWrite(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+
+	for i := 0; i < mockNumberOfElements; i++ {
+		val := createItem(strconv.Itoa(i))
+		err = collection.Put(val, val)
+		require.NoError(t, err)
+	}
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	oldMeta := *db.meta
+	oldRoot := collection.root
+
+	tx = db.WriteTx()
+	collection, err = tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+
+	val := createItem("7")
+	err = collection.Put(val, createItem("a"))
+	require.NoError(t, err)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	// The modified leaf and all of its ancestors moved to new pages, and the other meta page was written
+	assert.NotEqual(t, oldRoot, collection.root)
+	assert.NotEqual(t, oldMeta.root, db.root)
+	assert.NotEqual(t, oldMeta.freelistPage, db.freelistPage)
+	assert.Equal(t, oldMeta.txid+1, db.txid)
+	assert.NotEqual(t, oldMeta.pageNum(), db.meta.pageNum())
+	assert.Contains(t, db.releasedPages, oldRoot)
+	assert.Contains(t, db.releasedPages, oldMeta.root)
+
+	// The old tree is left untouched on the disk
+	oldRootNode, err := db.getNode(oldRoot)
+	require.NoError(t, err)
+	newRootNode, err := db.getNode(collection.root)
+	require.NoError(t, err)
+	assert.Equal(t, len(oldRootNode.items), len(newRootNode.items))
+	assert.NotEqual(t, oldRootNode.childNodes, newRootNode.childNodes)
+}
+
+func TestTx_ReopenPicksLatestMeta(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+
+	for i := 0; i < mockNumberOfElements; i++ {
+		tx := db.WriteTx()
+		collection, err := tx.GetCollection(testCollectionName)
+		require.NoError(t, err)
+		if collection == nil {
+			collection, err = tx.CreateCollection(testCollectionName)
+			require.NoError(t, err)
+		}
+
+		val := createItem(strconv.Itoa(i))
+		err = collection.Put(val, val)
+		require.NoError(t, err)
+
+		err = tx.Commit()
+		require.NoError(t, err)
+	}
+
+	expectedMeta := *db.meta
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, expectedMeta, *db.meta)
+
+	tx := db.ReadTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	for i := 0; i < mockNumberOfElements; i++ {
+		val := createItem(strconv.Itoa(i))
+		item, err := collection.Find(val)
+		require.NoError(t, err)
+		require.NotNil(t, item)
+		assert.Equal(t, val, item.Value())
+	}
+
+	err = tx.Commit()
+	require.NoError(t, err)
+}
+
+func TestTx_TornMetaPage(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+
+	tx := db.WriteTx()
+	_, err = tx.CreateCollection(testCollectionName)
+	require.NoError(t, err)
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	previousMeta := *db.meta
+
+	tx = db.WriteTx()
+	_, err = tx.CreateCollection([]byte("test2"))
+	require.NoError(t, err)
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	// Corrupt the meta page written by the last commit, as if the machine crashed while writing it
+	_, err = db.file.WriteAt([]byte("torn"), int64(db.meta.pageNum())*int64(db.pageSize)+magicNumberSize+checksumSize)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, previousMeta, *db.meta)
+
+	tx = db.ReadTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	assert.NotNil(t, collection)
+
+	collection, err = tx.GetCollection([]byte("test2"))
+	require.NoError(t, err)
+	assert.Nil(t, collection)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+}
+
+func TestTx_ReopenWithManyCollections(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+
+	const collectionsCount = 500
+	collectionName := func(i int) []byte {
+		return []byte("collection" + strconv.Itoa(i))
+	}
+
+	// Some transactions create a single collection, others many, so the root collection splits both during a
+	// transaction and between transactions
+	for i := 0; i < collectionsCount; {
+		tx := db.WriteTx()
+		for batchEnd := i + i%7 + 1; i < batchEnd && i < collectionsCount; i++ {
+			collection, err := tx.CreateCollection(collectionName(i))
+			require.NoError(t, err)
+
+			err = collection.Put([]byte("key"), collectionName(i))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tx.Commit())
+	}
+
+	rootNode, err := db.getNode(db.root)
+	require.NoError(t, err)
+	require.False(t, rootNode.isLeaf())
+	expectedMeta := *db.meta
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, options)
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedMeta, *db.meta)
+	tx := db.ReadTx()
+	for i := 0; i < collectionsCount; i++ {
+		collection, err := tx.GetCollection(collectionName(i))
+		require.NoError(t, err)
+		require.NotNil(t, collection, string(collectionName(i)))
+
+		item, err := collection.Find([]byte("key"))
+		require.NoError(t, err)
+		require.NotNil(t, item)
+		assert.Equal(t, collectionName(i), item.Value())
+	}
+	require.NoError(t, tx.Commit())
+
+	// Deleting most of the collections collapses the root collection
+	tx = db.WriteTx()
+	for i := 1; i < collectionsCount; i++ {
+		require.NoError(t, tx.DeleteCollection(collectionName(i)))
+	}
+	require.NoError(t, tx.Commit())
+
+	expectedMeta = *db.meta
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, expectedMeta, *db.meta)
+	rootNode, err = db.getNode(db.root)
+	require.NoError(t, err)
+	assert.True(t, rootNode.isLeaf())
+
+	tx = db.ReadTx()
+	collection, err := tx.GetCollection(collectionName(0))
+	require.NoError(t, err)
+	assert.NotNil(t, collection)
+	collection, err = tx.GetCollection(collectionName(1))
+	require.NoError(t, err)
+	assert.Nil(t, collection)
+	require.NoError(t, tx.Commit())
+}
+
+func TestTx_ListCollections(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	for _, name := range []string{"c", "a", "b"} {
+		_, err := tx.CreateCollection([]byte(name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tx.Commit())
+
+	tx = db.ReadTx()
+	defer tx.Commit()
+
+	names, err := tx.ListCollections()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, names)
+
+	var visited []string
+	err = tx.ForEachCollection(func(name []byte, collection *Collection) error {
+		assert.Equal(t, name, collection.name)
+		visited = append(visited, string(name))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, visited)
+
+	// An error returned by the callback stops the iteration
+	visited = nil
+	err = tx.ForEachCollection(func(name []byte, collection *Collection) error {
+		visited = append(visited, string(name))
+		return ErrCollectionNotFound
+	})
+	assert.ErrorIs(t, err, ErrCollectionNotFound)
+	assert.Equal(t, []string{"a"}, visited)
+}
+
+func TestTx_RenameCollection(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	tx := db.WriteTx()
+	collection, err := tx.CreateCollection([]byte("old"))
+	require.NoError(t, err)
+	for i := 0; i < mockNumberOfElements; i++ {
+		key := createItem(strconv.Itoa(i))
+		require.NoError(t, collection.Put(key, key))
+	}
+	_, err = tx.CreateCollection([]byte("other"))
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	tx = db.WriteTx()
+	collection, err = tx.GetCollection([]byte("old"))
+	require.NoError(t, err)
+	root := collection.root
+
+	assert.ErrorIs(t, tx.RenameCollection([]byte("missing"), []byte("new")), ErrCollectionNotFound)
+	assert.ErrorIs(t, tx.RenameCollection([]byte("old"), []byte("other")), ErrCollectionExists)
+	require.NoError(t, tx.RenameCollection([]byte("old"), []byte("new")))
+	require.NoError(t, tx.Commit())
+
+	tx = db.ReadTx()
+	defer tx.Commit()
+
+	collection, err = tx.GetCollection([]byte("old"))
+	require.NoError(t, err)
+	assert.Nil(t, collection)
+
+	// The tree of the collection wasn't copied
+	collection, err = tx.GetCollection([]byte("new"))
+	require.NoError(t, err)
+	require.NotNil(t, collection)
+	assert.Equal(t, root, collection.root)
+	for i := 0; i < mockNumberOfElements; i++ {
+		key := createItem(strconv.Itoa(i))
+		item, err := collection.Find(key)
+		require.NoError(t, err)
+		require.NotNil(t, item)
+		assert.Equal(t, key, item.Value())
+	}
+
+	names, err := tx.ListCollections()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("new"), []byte("other")}, names)
+}
+
+var errInjected = errors.New("injected write failure")
+
+func TestTx_CommitFailureRollsBack(t *testing.T) {
+	tests := []struct {
+		name string
+		wal  bool
+		step writeStep
+
+		// occurrence is the occurrence of the step that fails, starting at 1
+		occurrence int
+	}{
+		{name: "first page", step: writeStepPage, occurrence: 1},
+		{name: "later page", step: writeStepPage, occurrence: 3},
+		{name: "write barrier", step: writeStepBarrier, occurrence: 1},
+		{name: "meta page", step: writeStepMeta, occurrence: 1},
+		{name: "sync", step: writeStepSync, occurrence: 1},
+		{name: "wal append", wal: true, step: writeStepWAL, occurrence: 1},
+		{name: "wal sync", wal: true, step: writeStepSync, occurrence: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := getTempFileName()
+			options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+			if test.wal {
+				options = walTestOptions()
+			}
+			db, err := Open(path, options)
+			require.NoError(t, err)
+
+			putTestItems(t, db, "0", "1")
+			releasedPages, maxPage := slices.Clone(db.releasedPages), db.maxPage
+			expectedMeta := *db.meta
+
+			occurrences := 0
+			db.writeHook = func(step writeStep) error {
+				if step == test.step {
+					occurrences++
+					if occurrences == test.occurrence {
+						return errInjected
+					}
+				}
+				return nil
+			}
+
+			tx := db.WriteTx()
+			collection, err := tx.GetCollection(testCollectionName)
+			require.NoError(t, err)
+			for _, key := range []string{"2", "3", "4", "5"} {
+				require.NoError(t, collection.Put(createItem(key), createItem(key)))
+			}
+			require.NoError(t, collection.Remove(createItem("0")))
+			_, err = tx.CreateCollection([]byte("other"))
+			require.NoError(t, err)
+
+			err = tx.Commit()
+			require.ErrorIs(t, err, errInjected)
+			assert.ErrorContains(t, err, "could not commit transaction")
+
+			// The database is left as it was before the transaction, and the write lock is released
+			assert.Equal(t, expectedMeta, *db.meta)
+			assertPagesReleased(t, db, releasedPages, maxPage)
+			require.True(t, db.writeLock.TryLock())
+			db.writeLock.Unlock()
+			assertTestItems(t, db, true, "0", "1")
+			assertTestItems(t, db, false, "2", "3", "4", "5")
+
+			db.writeHook = nil
+			putTestItems(t, db, "6")
+			require.NoError(t, db.Close())
+
+			db, err = Open(path, options)
+			require.NoError(t, err)
+			defer db.Close()
+
+			assertTestItems(t, db, true, "0", "1", "6")
+			assertTestItems(t, db, false, "2", "3", "4", "5")
+		})
+	}
+}
+
+func TestTx_FailedMetaWriteIsInvalidated(t *testing.T) {
+	path := getTempFileName()
+	options := &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage}
+	db, err := Open(path, options)
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0")
+
+	// The meta page is written but syncing it fails. The database is reopened right away, without another commit
+	// overwriting the meta page, as if the process crashed.
+	db.writeHook = func(step writeStep) error {
+		if step == writeStepSync {
+			return errInjected
+		}
+		return nil
+	}
+	tx := db.WriteTx()
+	collection, err := tx.GetCollection(testCollectionName)
+	require.NoError(t, err)
+	require.NoError(t, collection.Put(createItem("1"), createItem("1")))
+	require.ErrorIs(t, tx.Commit(), errInjected)
+
+	expectedMeta := *db.meta
+	require.NoError(t, db.file.Close())
+
+	db, err = Open(path, options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, expectedMeta, *db.meta)
+	assertTestItems(t, db, true, "0")
+	assertTestItems(t, db, false, "1")
+}
+
+func TestTx_ClosedTx(t *testing.T) {
+	db, cleanFunc := createTestDB(t)
+	defer cleanFunc()
+
+	putTestItems(t, db, "0")
+
+	finish := map[string]func(tx *Tx) error{
+		"commit":   func(tx *Tx) error { return tx.Commit() },
+		"rollback": func(tx *Tx) error { return tx.Rollback() },
+	}
+	start := map[string]func() *Tx{
+		"read":  db.ReadTx,
+		"write": db.WriteTx,
+	}
+
+	for startName, startTx := range start {
+		for finishName, finishTx := range finish {
+			t.Run(startName+" "+finishName, func(t *testing.T) {
+				tx := startTx()
+				collection, err := tx.GetCollection(testCollectionName)
+				require.NoError(t, err)
+				cursor := collection.Cursor()
+				_, err = cursor.First()
+				require.NoError(t, err)
+
+				require.NoError(t, finishTx(tx))
+
+				// Finishing the transaction again doesn't release the lock twice
+				assert.ErrorIs(t, tx.Commit(), ErrTxClosed)
+				assert.ErrorIs(t, tx.Rollback(), ErrTxClosed)
+
+				_, err = tx.GetCollection(testCollectionName)
+				assert.ErrorIs(t, err, ErrTxClosed)
+				_, err = tx.CreateCollection([]byte("other"))
+				assert.ErrorIs(t, err, ErrTxClosed)
+				assert.ErrorIs(t, tx.DeleteCollection(testCollectionName), ErrTxClosed)
+				assert.ErrorIs(t, tx.RenameCollection(testCollectionName, []byte("other")), ErrTxClosed)
+				_, err = tx.ListCollections()
+				assert.ErrorIs(t, err, ErrTxClosed)
+				_, err = tx.Savepoint()
+				assert.ErrorIs(t, err, ErrTxClosed)
+
+				key := createItem("0")
+				_, err = collection.Find(key)
+				assert.ErrorIs(t, err, ErrTxClosed)
+				assert.ErrorIs(t, collection.Put(key, key), ErrTxClosed)
+				assert.ErrorIs(t, collection.Remove(key), ErrTxClosed)
+				_, err = collection.Stats()
+				assert.ErrorIs(t, err, ErrTxClosed)
+				assert.ErrorIs(t, collection.Scan(nil, nil, nil, func(*Item) bool { return true }), ErrTxClosed)
+				assert.Equal(t, uint64(0), collection.ID())
+
+				_, err = cursor.Next()
+				assert.ErrorIs(t, err, ErrTxClosed)
+				_, err = cursor.Seek(key)
+				assert.ErrorIs(t, err, ErrTxClosed)
+
+				// The lock was released once
+				require.True(t, db.writeLock.TryLock())
+				db.writeLock.Unlock()
+				assert.Empty(t, db.readers)
+			})
+		}
+	}
 }
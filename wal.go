@@ -0,0 +1,301 @@
+package gonosql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	walFileSuffix = "-wal"
+
+	// walFrameHeaderSize is the size of the header written before every page in the log: the page number, the id of
+	// the transaction the frame belongs to, the frame flags and the checksum of the frame.
+	walFrameHeaderSize = pageNumSize + txIDSize + 4 + checksumSize
+
+	// walFrameCommit marks the last frame of a transaction. Frames are considered committed only once the frame that
+	// carries this flag is in the log.
+	walFrameCommit uint32 = 1 << 0
+
+	// defaultWALCheckpointPages is the number of pages the log may hold before it's automatically checkpointed.
+	defaultWALCheckpointPages = 1000
+)
+
+// wal is a write-ahead log kept in a sidecar file next to the database file. Instead of writing its pages into the
+// database file, a transaction appends them to the log as frames, followed by a frame holding the meta page which marks
+// the commit. Pages are read from the log as long as it holds them. A checkpoint copies the latest version of every
+// page in the log to the database file, and then truncates the log.
+//
+// Each frame is structured as:
+// ---------------------------------------------------------------------
+// | page number | txid | flags | checksum |          page data         |
+// ---------------------------------------------------------------------
+type wal struct {
+	file     *os.File
+	pageSize int
+
+	// mu protects the index from the read transactions, which read pages alongside the writer. Only the writer
+	// modifies the log, so it reads the index without taking the lock.
+	mu sync.RWMutex
+
+	// index maps a page to the offset of its latest committed frame in the log.
+	index map[pageNum]int64
+
+	// size is the size of the committed part of the log.
+	size int64
+}
+
+func walPath(path string) string {
+	return path + walFileSuffix
+}
+
+func frameSize(pageSize int) int64 {
+	return int64(walFrameHeaderSize + pageSize)
+}
+
+// openWAL opens the log at the given path, creating it if it doesn't exist, and loads the frames of all the
+// committed transactions in it.
+func openWAL(path string, pageSize int) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{
+		file:     file,
+		pageSize: pageSize,
+		index:    map[pageNum]int64{},
+	}
+
+	err = w.recover()
+	if err == nil {
+		err = w.file.Truncate(w.size)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// openWALReadOnly opens an existing log for reading only. Its committed frames are loaded, but the log is left as is.
+func openWALReadOnly(path string, pageSize int) (*wal, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{
+		file:     file,
+		pageSize: pageSize,
+		index:    map[pageNum]int64{},
+	}
+
+	err = w.recover()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// recover scans the log and indexes the frames of committed transactions. The scan stops at the first frame that is
+// incomplete or whose checksum doesn't match, which is what a crash in the middle of an append leaves behind. Frames
+// of a transaction whose commit frame is missing are discarded, and the size of the log is set to the end of the last
+// commit.
+func (w *wal) recover() error {
+	frame := make([]byte, frameSize(w.pageSize))
+	pending := map[pageNum]int64{}
+	var offset int64
+	var txid uint64
+
+	for {
+		_, err := w.file.ReadAt(frame, offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		framePgNum, frameTxID, flags, ok := decodeFrameHeader(frame)
+		if !ok || (len(pending) > 0 && frameTxID != txid) {
+			break
+		}
+
+		txid = frameTxID
+		pending[framePgNum] = offset
+		offset += int64(len(frame))
+
+		if flags&walFrameCommit != 0 {
+			for pgNum, frameOffset := range pending {
+				w.index[pgNum] = frameOffset
+			}
+			pending = map[pageNum]int64{}
+			w.size = offset
+		}
+	}
+
+	return nil
+}
+
+func encodeFrame(buf []byte, p *page, txid uint64, flags uint32) {
+	pos := 0
+	binary.LittleEndian.PutUint64(buf[pos:], uint64(p.num))
+	pos += pageNumSize
+
+	binary.LittleEndian.PutUint64(buf[pos:], txid)
+	pos += txIDSize
+
+	binary.LittleEndian.PutUint32(buf[pos:], flags)
+	pos += 4
+
+	checksumPos := pos
+	pos += checksumSize
+
+	copy(buf[pos:], p.data)
+	binary.LittleEndian.PutUint32(buf[checksumPos:], frameChecksum(buf))
+}
+
+func decodeFrameHeader(buf []byte) (pageNum, uint64, uint32, bool) {
+	pos := 0
+	pgNum := pageNum(binary.LittleEndian.Uint64(buf[pos:]))
+	pos += pageNumSize
+
+	txid := binary.LittleEndian.Uint64(buf[pos:])
+	pos += txIDSize
+
+	flags := binary.LittleEndian.Uint32(buf[pos:])
+	pos += 4
+
+	checksum := binary.LittleEndian.Uint32(buf[pos:])
+	return pgNum, txid, flags, checksum == frameChecksum(buf)
+}
+
+// frameChecksum computes the checksum of a frame over its header, without the checksum itself, and its data.
+func frameChecksum(buf []byte) uint32 {
+	checksumPos := walFrameHeaderSize - checksumSize
+	checksum := crc32.Checksum(buf[:checksumPos], castagnoliTable)
+	return crc32.Update(checksum, castagnoliTable, buf[walFrameHeaderSize:])
+}
+
+// walFrames are the frames of a transaction appended to the log, which aren't indexed yet.
+type walFrames struct {
+	offsets map[pageNum]int64
+	size    int64
+}
+
+// append writes the pages of a transaction to the end of the log, followed by the meta page as the commit frame.
+// Syncing the log is left to the caller, and the frames are read only once they're published.
+func (w *wal) append(pages []*page, metaPage *page, txid uint64) (*walFrames, error) {
+	size := frameSize(w.pageSize)
+	buf := make([]byte, int64(len(pages)+1)*size)
+
+	frames := append(pages[:len(pages):len(pages)], metaPage)
+	offsets := make(map[pageNum]int64, len(frames))
+	for i, p := range frames {
+		var flags uint32
+		if p == metaPage {
+			flags = walFrameCommit
+		}
+
+		frameOffset := int64(i) * size
+		encodeFrame(buf[frameOffset:frameOffset+size], p, txid, flags)
+		offsets[p.num] = w.size + frameOffset
+	}
+
+	_, err := w.file.WriteAt(buf, w.size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &walFrames{offsets: offsets, size: int64(len(buf))}, nil
+}
+
+// publish indexes the appended frames of a committed transaction, so its pages are read from the log.
+func (w *wal) publish(frames *walFrames) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for pgNum, offset := range frames.offsets {
+		w.index[pgNum] = offset
+	}
+	w.size += frames.size
+}
+
+// discard truncates the frames appended after the last published transaction, so they aren't replayed on recovery.
+// It's best effort: if truncating fails, the frames are overwritten by the next transaction.
+func (w *wal) discard() {
+	_ = w.file.Truncate(w.size)
+}
+
+// readPage reads the latest committed version of a page from the log. False is returned if the log doesn't hold it.
+func (w *wal) readPage(p *page) (bool, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	offset, ok := w.index[p.num]
+	if !ok {
+		return false, nil
+	}
+
+	_, err := w.file.ReadAt(p.data, offset+walFrameHeaderSize)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// checkpoint copies the latest version of every page in the log to the database file, syncs it and truncates the log.
+func (w *wal) checkpoint(file *os.File) error {
+	if len(w.index) == 0 {
+		return nil
+	}
+
+	data := make([]byte, w.pageSize)
+	for pgNum, offset := range w.index {
+		_, err := w.file.ReadAt(data, offset+walFrameHeaderSize)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.WriteAt(data, int64(pgNum)*int64(w.pageSize))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := fdatasync(file)
+	if err != nil {
+		return err
+	}
+
+	// The pages are in the database file now, so readers can read them from there once the log is truncated
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err = w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	w.index = map[pageNum]int64{}
+	w.size = 0
+	return fdatasync(w.file)
+}
+
+func (w *wal) close() error {
+	err := w.file.Close()
+	if err != nil {
+		return fmt.Errorf("could not close wal file: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package gonosql
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func walTestOptions() *Options {
+	return &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage, WAL: true, WALCheckpointSize: -1}
+}
+
+// crashTestDB closes the files of the database without checkpointing the log, as if the process crashed.
+func crashTestDB(t *testing.T, db *DB) {
+	require.NoError(t, db.wal.close())
+	require.NoError(t, db.file.Close())
+}
+
+func TestWAL_CommitAppendsToLog(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, walTestOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	fileInfo, err := db.file.Stat()
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0", "1", "2", "3", "4")
+
+	// The database file isn't modified, the pages are in the log
+	newFileInfo, err := db.file.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, fileInfo.Size(), newFileInfo.Size())
+	assert.NotZero(t, db.wal.size)
+	assert.Contains(t, db.wal.index, db.meta.pageNum())
+
+	assertTestItems(t, db, true, "0", "1", "2", "3", "4")
+}
+
+func TestWAL_RecoverAfterCrash(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, walTestOptions())
+	require.NoError(t, err)
+
+	for i := 0; i < mockNumberOfElements; i++ {
+		putTestItems(t, db, strconv.Itoa(i))
+	}
+	expectedMeta := *db.meta
+	crashTestDB(t, db)
+
+	db, err = Open(path, walTestOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, expectedMeta, *db.meta)
+	assert.Empty(t, db.wal.index)
+	for i := 0; i < mockNumberOfElements; i++ {
+		assertTestItems(t, db, true, strconv.Itoa(i))
+	}
+}
+
+func TestWAL_RecoverDiscardsTornTail(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, walTestOptions())
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0", "1")
+	expectedMeta := *db.meta
+	committedSize := db.wal.size
+
+	// A transaction that crashed in the middle of its append: one full frame without a commit frame, followed by a
+	// partially written frame.
+	frame := make([]byte, frameSize(db.pageSize))
+	p := db.allocateEmptyPage()
+	p.num = db.maxPage + 1
+	encodeFrame(frame, p, db.txid+1, 0)
+	_, err = db.wal.file.WriteAt(append(frame, frame[:100]...), committedSize)
+	require.NoError(t, err)
+	crashTestDB(t, db)
+
+	w, err := openWAL(walPath(path), os.Getpagesize())
+	require.NoError(t, err)
+	assert.Equal(t, committedSize, w.size)
+	assert.NotContains(t, w.index, p.num)
+	fileInfo, err := w.file.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, committedSize, fileInfo.Size())
+	require.NoError(t, w.close())
+
+	db, err = Open(path, walTestOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, expectedMeta, *db.meta)
+	assertTestItems(t, db, true, "0", "1")
+}
+
+func TestWAL_RecoverDiscardsCorruptFrame(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, walTestOptions())
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0")
+	expectedMeta := *db.meta
+	committedSize := db.wal.size
+
+	putTestItems(t, db, "1")
+
+	// Corrupt a page of the second transaction
+	_, err = db.wal.file.WriteAt([]byte("corrupt"), committedSize+walFrameHeaderSize+10)
+	require.NoError(t, err)
+	crashTestDB(t, db)
+
+	db, err = Open(path, walTestOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, expectedMeta, *db.meta)
+	assertTestItems(t, db, true, "0")
+	assertTestItems(t, db, false, "1")
+}
+
+func TestWAL_Checkpoint(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, walTestOptions())
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0", "1", "2")
+	err = db.Checkpoint()
+	require.NoError(t, err)
+
+	assert.Zero(t, db.wal.size)
+	assert.Empty(t, db.wal.index)
+	fileInfo, err := db.wal.file.Stat()
+	require.NoError(t, err)
+	assert.Zero(t, fileInfo.Size())
+
+	assertTestItems(t, db, true, "0", "1", "2")
+	crashTestDB(t, db)
+
+	// The database file holds everything without the log
+	require.NoError(t, os.Remove(walPath(path)))
+	db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assertTestItems(t, db, true, "0", "1", "2")
+}
+
+func TestWAL_AutoCheckpoint(t *testing.T) {
+	options := walTestOptions()
+	options.WALCheckpointSize = 1
+	db, err := Open(getTempFileName(), options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	putTestItems(t, db, "0", "1")
+	assert.Zero(t, db.wal.size)
+	assertTestItems(t, db, true, "0", "1")
+}
+
+func TestWAL_CloseCheckpointsAndRemovesLog(t *testing.T) {
+	path := getTempFileName()
+	db, err := Open(path, walTestOptions())
+	require.NoError(t, err)
+
+	putTestItems(t, db, "0", "1")
+	require.NoError(t, db.Close())
+
+	_, err = os.Stat(walPath(path))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	db, err = Open(path, &Options{MinFillPercent: testMinPercentage, MaxFillPercent: testMaxPercentage})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assertTestItems(t, db, true, "0", "1")
+}
+
+func TestWAL_ConcurrentReadersAndWriter(t *testing.T) {
+	options := walTestOptions()
+	options.WALCheckpointSize = 20 * frameSize(os.Getpagesize())
+	db, err := Open(getTempFileName(), options)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// The log is checkpointed every few commits, while readers read pages from it
+	testConcurrentReadersAndWriter(t, db)
+}